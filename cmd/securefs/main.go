@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/japinder12/securefs-go/pkg/securefs"
 )
 
@@ -15,7 +24,7 @@ func main() {
 		return
 	}
 
-	store, err := securefs.OpenStore(".securefs.json")
+	store, err := securefs.OpenStore(".securefs.json", securefs.WithStateFile(statePath()))
 	if err != nil { panic(err) }
 
 	switch os.Args[1] {
@@ -32,9 +41,62 @@ func main() {
 		user := fs.String("user", "", "username")
 		pass := fs.String("pass", "", "password")
 		fs.Parse(os.Args[2:])
-		_, err := securefs.Login(store, *user, *pass)
+		c, err := securefs.Login(store, *user, *pass)
 		check(err)
 		fmt.Println("ok")
+		if n := c.Unread(); n > 0 {
+			msgs, err := c.Inbox()
+			check(err)
+			fmt.Printf("%d message(s) in your inbox:\n", n)
+			printInbox(msgs)
+		}
+		if p := store.OrgEscrow; p != nil {
+			fmt.Printf("note: new file keys in this store are escrowed to org key %s\n", p.Fingerprint())
+		}
+	case "inbox":
+		fs := flag.NewFlagSet("inbox", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		fs.Parse(os.Args[2:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		msgs, err := c.Inbox()
+		check(err)
+		printInbox(msgs)
+	case "dismiss":
+		fs := flag.NewFlagSet("dismiss", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		id := fs.String("id", "", "inbox message ID")
+		fs.Parse(os.Args[2:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		mid, err := uuid.Parse(*id)
+		check(err)
+		check(c.Dismiss(mid))
+		fmt.Println("ok")
+	case "recovery-codes":
+		fs := flag.NewFlagSet("recovery-codes", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		fs.Parse(os.Args[2:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		codes, err := c.GenerateRecoveryCodes()
+		check(err)
+		fmt.Println("store these somewhere safe; each works once and any older codes no longer work:")
+		for _, code := range codes {
+			fmt.Println(code)
+		}
+	case "recover":
+		fs := flag.NewFlagSet("recover", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		code := fs.String("code", "", "recovery code")
+		newPass := fs.String("new-pass", "", "new password")
+		fs.Parse(os.Args[2:])
+		c, err := securefs.Recover(store, *user, *code, *newPass)
+		check(err)
+		fmt.Printf("ok, password reset; %d recovery codes left\n", c.RecoveryCodesLeft())
 	case "put":
 		fs := flag.NewFlagSet("put", flag.ExitOnError)
 		user := fs.String("user", "", "username")
@@ -73,9 +135,15 @@ func main() {
 		user := fs.String("user", "", "username")
 		pass := fs.String("pass", "", "password")
 		name := fs.String("name", "", "filename")
+		to := fs.String("to", "", "share target, user:NAME or group:NAME; omit for a capability code")
 		fs.Parse(os.Args[2:])
 		c, err := securefs.Login(store, *user, *pass)
 		check(err)
+		if *to != "" {
+			check(c.ShareWith(*name, *to))
+			fmt.Println("ok")
+			return
+		}
 		code, err := c.CreateShare(*name)
 		check(err)
 		fmt.Println(code)
@@ -85,10 +153,17 @@ func main() {
 		pass := fs.String("pass", "", "password")
 		as := fs.String("as", "", "save as filename")
 		code := fs.String("code", "", "share code")
+		msg := fs.String("inbox", "", "accept the share in this inbox message instead of --code")
 		fs.Parse(os.Args[2:])
 		c, err := securefs.Login(store, *user, *pass)
 		check(err)
-		check(c.AcceptShare(*as, *code))
+		if *msg != "" {
+			id, err := uuid.Parse(*msg)
+			check(err)
+			check(c.AcceptFromInbox(id, *as))
+		} else {
+			check(c.AcceptShare(*as, *code))
+		}
 		fmt.Println("ok")
 	case "revoke":
 		fs := flag.NewFlagSet("revoke", flag.ExitOnError)
@@ -100,6 +175,391 @@ func main() {
 		check(err)
 		check(c.Revoke(*name))
 		fmt.Println("ok")
+	case "rm":
+		fs := flag.NewFlagSet("rm", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "filename")
+		fs.Parse(os.Args[2:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		check(c.Delete(*name))
+		fmt.Println("ok")
+	case "snapshot":
+		if len(os.Args) < 3 {
+			usage()
+			return
+		}
+		fs := flag.NewFlagSet("snapshot "+os.Args[2], flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		label := fs.String("label", "", "snapshot label")
+		name := fs.String("name", "", "filename (restore: all files if empty)")
+		fs.Parse(os.Args[3:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		switch os.Args[2] {
+		case "create":
+			check(c.Snapshot(*label))
+			fmt.Println("ok")
+		case "list":
+			for _, sn := range c.ListSnapshots() {
+				fmt.Printf("%s\t%s\t%d files\n", sn.Label, sn.Time.Format(time.RFC3339), sn.Files)
+			}
+		case "ls":
+			names, err := c.SnapshotFiles(*label)
+			check(err)
+			for _, n := range names {
+				fmt.Println(n)
+			}
+		case "get":
+			b, err := c.LoadSnapshotFile(*label, *name)
+			check(err)
+			fmt.Println(string(b))
+		case "restore":
+			if *name == "" {
+				check(c.RestoreSnapshot(*label))
+			} else {
+				check(c.RestoreSnapshotFile(*label, *name))
+			}
+			fmt.Println("ok")
+		case "delete":
+			check(c.DeleteSnapshot(*label))
+			fmt.Println("ok")
+		default:
+			usage()
+		}
+	case "history":
+		if len(os.Args) < 3 {
+			usage()
+			return
+		}
+		fs := flag.NewFlagSet("history "+os.Args[2], flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "filename")
+		version := fs.Int("version", 0, "version number")
+		keep := fs.Int("keep", 0, "versions to keep (0 = no limit)")
+		days := fs.Int("days", 0, "days to keep versions (0 = no limit)")
+		fs.Parse(os.Args[3:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		switch os.Args[2] {
+		case "enable":
+			policy := securefs.RetentionPolicy{KeepVersions: *keep, KeepFor: time.Duration(*days) * 24 * time.Hour}
+			check(c.EnableHistory(*name, policy))
+			fmt.Println("ok")
+		case "disable":
+			check(c.DisableHistory(*name))
+			fmt.Println("ok")
+		case "list":
+			vs, err := c.ListVersions(*name)
+			check(err)
+			for _, v := range vs {
+				fmt.Printf("%d\t%s\t%d bytes\n", v.Version, v.Time.Format(time.RFC3339), v.Size)
+			}
+		case "get":
+			b, err := c.LoadVersion(*name, *version)
+			check(err)
+			fmt.Println(string(b))
+		case "restore":
+			check(c.RestoreVersion(*name, *version))
+			fmt.Println("ok")
+		case "prune":
+			n, err := c.PruneVersions(*name)
+			check(err)
+			fmt.Printf("dropped %d versions\n", n)
+		default:
+			usage()
+		}
+	case "dedup":
+		if len(os.Args) < 3 {
+			usage()
+			return
+		}
+		fs := flag.NewFlagSet("dedup "+os.Args[2], flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "filename")
+		fs.Parse(os.Args[3:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		switch os.Args[2] {
+		case "enable":
+			check(c.EnableDedup(*name))
+			fmt.Println("ok")
+		case "disable":
+			check(c.DisableDedup(*name))
+			fmt.Println("ok")
+		default:
+			usage()
+		}
+	case "group":
+		if len(os.Args) < 3 {
+			usage()
+			return
+		}
+		fs := flag.NewFlagSet("group "+os.Args[2], flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "group name")
+		members := fs.String("members", "", "comma-separated usernames")
+		member := fs.String("member", "", "username")
+		revokePrior := fs.Bool("revoke-prior", false, "also re-key files shared before the removal")
+		fs.Parse(os.Args[3:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		switch os.Args[2] {
+		case "create":
+			var ms []string
+			if *members != "" {
+				ms = strings.Split(*members, ",")
+			}
+			check(c.CreateGroup(*name, ms))
+			fmt.Println("ok")
+		case "add":
+			check(c.AddGroupMember(*name, *member))
+			fmt.Println("ok")
+		case "remove":
+			check(c.RemoveGroupMember(*name, *member, *revokePrior))
+			fmt.Println("ok")
+		case "list":
+			for _, g := range c.Groups() {
+				fmt.Printf("%s\towner %s\t%d files\tkey epoch %d\t%s\n", g.Name, g.Owner, g.Files, g.Epoch, strings.Join(g.Members, ","))
+			}
+		default:
+			usage()
+		}
+	case "escrow":
+		if len(os.Args) < 3 {
+			usage()
+			return
+		}
+		fs := flag.NewFlagSet("escrow "+os.Args[2], flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		trustees := fs.String("trustees", "", "comma-separated trustee usernames")
+		threshold := fs.Int("threshold", 0, "trustee approvals needed to recover")
+		owner := fs.String("owner", "", "user whose recovery to approve")
+		fingerprint := fs.String("fingerprint", "", "request fingerprint the owner gave you")
+		reqKey := fs.String("request", "", "request key printed by escrow request")
+		newPass := fs.String("new-pass", "", "new password")
+		fs.Parse(os.Args[3:])
+		switch os.Args[2] {
+		case "setup":
+			c, err := securefs.Login(store, *user, *pass)
+			check(err)
+			check(c.SetupEscrow(strings.Split(*trustees, ","), *threshold))
+			fmt.Println("ok")
+		case "disable":
+			c, err := securefs.Login(store, *user, *pass)
+			check(err)
+			check(c.DisableEscrow())
+			fmt.Println("ok")
+		case "request":
+			req, err := securefs.RequestEscrowRecovery(store, *user)
+			check(err)
+			fmt.Printf("fingerprint %s (read this to your trustees)\n", req.Fingerprint)
+			fmt.Printf("request key %s (keep this secret until you run escrow complete)\n", base64.StdEncoding.EncodeToString(req.PrivateKey))
+		case "pending":
+			c, err := securefs.Login(store, *user, *pass)
+			check(err)
+			for _, p := range c.PendingEscrowRequests() {
+				fmt.Printf("%s\t%s\t%s\t%d/%d approvals\tapproved by you: %v\n", p.User, p.Fingerprint, p.Time.Format(time.RFC3339), p.Approvals, p.Threshold, p.Approved)
+			}
+		case "approve":
+			c, err := securefs.Login(store, *user, *pass)
+			check(err)
+			check(c.ApproveEscrowRecovery(*owner, *fingerprint))
+			fmt.Println("ok")
+		case "complete":
+			key, err := base64.StdEncoding.DecodeString(*reqKey)
+			check(err)
+			_, err = securefs.CompleteEscrowRecovery(store, &securefs.EscrowRequest{User: *user, PrivateKey: key}, *newPass)
+			check(err)
+			fmt.Println("ok, password reset")
+		default:
+			usage()
+		}
+	case "compress":
+		fs := flag.NewFlagSet("compress", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "filename")
+		codec := fs.String("codec", "deflate", "codec for new writes: deflate or none")
+		fs.Parse(os.Args[2:])
+		cd, err := securefs.ParseCodec(*codec)
+		check(err)
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		check(c.SetCompression(*name, cd))
+		fmt.Println("ok")
+	case "pad":
+		fs := flag.NewFlagSet("pad", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "filename")
+		mode := fs.String("policy", "pow2", "padding for new writes: none, pow2, buckets or fixed")
+		buckets := fs.String("buckets", "", "comma-separated envelope sizes for --policy buckets")
+		fs.Parse(os.Args[2:])
+		m, err := securefs.ParsePadMode(*mode)
+		check(err)
+		policy := securefs.PaddingPolicy{Mode: m}
+		for _, f := range strings.Split(*buckets, ",") {
+			if f == "" {
+				continue
+			}
+			n, err := strconv.Atoi(f)
+			check(err)
+			policy.Buckets = append(policy.Buckets, n)
+		}
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		check(c.SetPadding(*name, policy))
+		fmt.Println("ok")
+	case "stat":
+		fs := flag.NewFlagSet("stat", flag.ExitOnError)
+		user := fs.String("user", "", "username")
+		pass := fs.String("pass", "", "password")
+		name := fs.String("name", "", "filename")
+		fs.Parse(os.Args[2:])
+		c, err := securefs.Login(store, *user, *pass)
+		check(err)
+		fi, err := c.Stat(*name)
+		check(err)
+		fmt.Printf("size %d bytes, stored %d bytes in %d chunks\n", fi.Size, fi.Stored, fi.Chunks)
+		fmt.Printf("compression %s, padding %s, dedup %v, history %v, escrowed %v\n", fi.Compression, fi.Padding.Mode, fi.Dedup, fi.History, fi.Escrowed)
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		dry := fs.Bool("dry-run", false, "report reclaimable space without deleting")
+		fs.Parse(os.Args[2:])
+		var rep securefs.GCReport
+		if *dry {
+			rep = store.GCDryRun()
+		} else {
+			rep, err = store.GC()
+			check(err)
+		}
+		verb := "reclaimed"
+		if rep.DryRun {
+			verb = "reclaimable"
+		}
+		fmt.Printf("%s: %d files, %d chunks, %d bytes\n", verb, rep.Files, rep.Chunks, rep.Bytes)
+	case "compact":
+		fs := flag.NewFlagSet("compact", flag.ExitOnError)
+		gc := fs.Bool("gc", false, "collect unreachable records and chunks first")
+		fs.Parse(os.Args[2:])
+		if *gc {
+			_, err := store.GC()
+			check(err)
+		}
+		rep, err := store.Compact()
+		check(err)
+		fmt.Printf("%d -> %d bytes\n", rep.Before, rep.After)
+	case "fsck":
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		user := fs.String("user", "", "username (optional: also decrypt and verify that user's files)")
+		pass := fs.String("pass", "", "password")
+		asJSON := fs.Bool("json", false, "print the report as JSON")
+		fs.Parse(os.Args[2:])
+		var rep *securefs.CheckReport
+		if *user != "" {
+			c, err := securefs.Login(store, *user, *pass)
+			check(err)
+			rep = c.Check()
+		} else {
+			rep = store.Check()
+		}
+		if *asJSON {
+			b, _ := json.MarshalIndent(rep, "", "  ")
+			fmt.Println(string(b))
+		} else {
+			for _, p := range rep.Problems {
+				fmt.Printf("%s\t%s\t%s\t%s\n", p.Severity, p.Kind, p.Subject, p.Detail)
+			}
+			fmt.Printf("%d users, %d files, %d chunks, %d verified, %d problems\n",
+				rep.Users, rep.Files, rep.Chunks, rep.Verified, len(rep.Problems))
+		}
+		if rep.Corrupt() {
+			os.Exit(1)
+		}
+	case "cipher":
+		fs := flag.NewFlagSet("cipher", flag.ExitOnError)
+		suite := fs.String("suite", "", "set the default AEAD: aes-256-gcm or xchacha20-poly1305")
+		fs.Parse(os.Args[2:])
+		if *suite != "" {
+			st, err := securefs.ParseSuite(*suite)
+			check(err)
+			check(store.SetCipher(st))
+		}
+		fmt.Println(store.CipherSuite())
+	case "org-escrow":
+		if len(os.Args) < 3 {
+			usage()
+			return
+		}
+		fs := flag.NewFlagSet("org-escrow "+os.Args[2], flag.ExitOnError)
+		out := fs.String("out", "org-escrow.key", "where keygen writes the private key")
+		pubFile := fs.String("pub", "org-escrow.pub", "public key file")
+		fs.Parse(os.Args[3:])
+		switch os.Args[2] {
+		case "keygen":
+			priv, pub, err := securefs.GenerateOrgEscrowKey()
+			check(err)
+			check(writeKeyPEM(*out, "PRIVATE KEY", priv, 0o600))
+			check(writeKeyPEM(*pubFile, "PUBLIC KEY", pub, 0o644))
+			fmt.Printf("wrote %s and %s, fingerprint %s\n", *out, *pubFile, securefs.Fingerprint(pub))
+		case "enable":
+			pub, err := readKeyPEM(*pubFile, "PUBLIC KEY")
+			check(err)
+			check(store.SetOrgEscrow(pub))
+			fmt.Printf("ok, new file keys escrowed to %s\n", securefs.Fingerprint(pub))
+		case "disable":
+			check(store.ClearOrgEscrow())
+			fmt.Println("ok, existing escrowed keys stay escrowed until rotated")
+		case "show":
+			if p := store.OrgEscrow; p != nil {
+				fmt.Printf("active since %s, key %s\n", p.Since.Format(time.RFC3339), p.Fingerprint())
+			} else {
+				fmt.Println("none")
+			}
+		default:
+			usage()
+		}
+	case "escrow-decrypt":
+		fs := flag.NewFlagSet("escrow-decrypt", flag.ExitOnError)
+		keyFile := fs.String("key", "org-escrow.key", "org escrow private key file")
+		root := fs.String("root", "", "file root to decrypt; omit to list escrowed files")
+		fs.Parse(os.Args[2:])
+		priv, err := readKeyPEM(*keyFile, "PRIVATE KEY")
+		check(err)
+		if *root == "" {
+			files, err := securefs.OrgEscrowFiles(store, priv)
+			check(err)
+			for _, f := range files {
+				fmt.Printf("%s\t%s\t%s\t%d bytes\n", f.Root, f.Owner, f.Name, f.Size)
+			}
+			return
+		}
+		id, err := uuid.Parse(*root)
+		check(err)
+		data, err := securefs.OrgEscrowDecrypt(store, priv, id)
+		check(err)
+		os.Stdout.Write(data)
+	case "convert":
+		fs := flag.NewFlagSet("convert", flag.ExitOnError)
+		to := fs.String("to", "", "target encoding: json or binary")
+		fs.Parse(os.Args[2:])
+		switch *to {
+		case "json":
+			check(store.SetEncoding(securefs.EncodingJSON))
+		case "binary":
+			check(store.SetEncoding(securefs.EncodingBinary))
+		default:
+			usage()
+			return
+		}
+		fmt.Println("ok")
 	case "dump":
 		// for debugging: print store
 		b, _ := json.MarshalIndent(store, "", "  ")
@@ -114,15 +574,115 @@ func usage() {
 Usage:
   securefs signup  --user U --pass P
   securefs login   --user U --pass P
+  securefs recovery-codes --user U --pass P
+  securefs recover --user U --code CODE --new-pass P
   securefs put     --user U --pass P --name F --data "hello"
   securefs get     --user U --pass P --name F
   securefs append  --user U --pass P --name F --data "more"
-  securefs share   --user U --pass P --name F
-  securefs accept  --user U --pass P --as G --code CODE
+  securefs share   --user U --pass P --name F [--to user:V|group:G]
+  securefs accept  --user U --pass P --as G --code CODE | --inbox ID
+  securefs inbox   --user U --pass P
+  securefs dismiss --user U --pass P --id ID
   securefs revoke  --user U --pass P --name F
+  securefs rm      --user U --pass P --name F
+  securefs snapshot create  --user U --pass P --label L
+  securefs snapshot list    --user U --pass P
+  securefs snapshot ls      --user U --pass P --label L
+  securefs snapshot get     --user U --pass P --label L --name F
+  securefs snapshot restore --user U --pass P --label L [--name F]
+  securefs snapshot delete  --user U --pass P --label L
+  securefs dedup enable|disable --user U --pass P --name F
+  securefs group create --user U --pass P --name G [--members A,B]
+  securefs group add|remove --user U --pass P --name G --member M [--revoke-prior]
+  securefs group list   --user U --pass P
+  securefs escrow setup    --user U --pass P --trustees T1,T2,T3 --threshold K
+  securefs escrow disable  --user U --pass P
+  securefs escrow request  --user U
+  securefs escrow pending  --user T --pass P
+  securefs escrow approve  --user T --pass P --owner U --fingerprint FP
+  securefs escrow complete --user U --request KEY --new-pass P
+  securefs compress --user U --pass P --name F [--codec deflate|none]
+  securefs pad      --user U --pass P --name F [--policy none|pow2|buckets|fixed] [--buckets 1024,8192]
+  securefs stat     --user U --pass P --name F
+  securefs gc      [--dry-run]
+  securefs compact [--gc]
+  securefs convert --to json|binary
+  securefs org-escrow keygen [--out org-escrow.key] [--pub org-escrow.pub]
+  securefs org-escrow enable [--pub org-escrow.pub]
+  securefs org-escrow disable|show
+  securefs escrow-decrypt [--key org-escrow.key] [--root ROOT]
+  securefs cipher  [--suite aes-256-gcm|xchacha20-poly1305]
+  securefs fsck    [--user U --pass P] [--json]
+  securefs history enable  --user U --pass P --name F [--keep N] [--days D]
+  securefs history disable --user U --pass P --name F
+  securefs history list    --user U --pass P --name F
+  securefs history get     --user U --pass P --name F --version V
+  securefs history restore --user U --pass P --name F --version V
+  securefs history prune   --user U --pass P --name F
 `)
 }
 
+// statePath is where this machine remembers the newest store epoch it
+// has seen: $SECUREFS_STATE, or securefs/state.json in the user config dir.
+func statePath() string {
+	if p := os.Getenv("SECUREFS_STATE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "securefs", "state.json")
+}
+
 func check(err error) {
 	if err != nil { panic(err) }
 }
+
+// printInbox lists inbox messages, one per line.
+func printInbox(msgs []securefs.InboxMessage) {
+	for _, m := range msgs {
+		what := m.Name
+		if m.Group != "" {
+			what = fmt.Sprintf("%s (group %s)", m.Name, m.Group)
+		}
+		fmt.Printf("%s\t%s\t%s\tfrom %s\t%s\n", m.ID, m.Time.Format(time.RFC3339), m.Kind, m.From, what)
+	}
+}
+
+// writeKeyPEM and readKeyPEM store raw X25519 keys in PKCS #8 / PKIX PEM
+// files, so standard tools can read them.
+func writeKeyPEM(path, typ string, key []byte, perm os.FileMode) error {
+	var der []byte
+	var err error
+	if typ == "PRIVATE KEY" {
+		k, kerr := ecdh.X25519().NewPrivateKey(key)
+		if kerr != nil { return kerr }
+		der, err = x509.MarshalPKCS8PrivateKey(k)
+	} else {
+		k, kerr := ecdh.X25519().NewPublicKey(key)
+		if kerr != nil { return kerr }
+		der, err = x509.MarshalPKIXPublicKey(k)
+	}
+	if err != nil { return err }
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm)
+}
+
+func readKeyPEM(path, typ string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil { return nil, err }
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != typ { return nil, fmt.Errorf("%s: no %s block", path, typ) }
+	if typ == "PRIVATE KEY" {
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil { return nil, err }
+		xk, ok := k.(*ecdh.PrivateKey)
+		if !ok { return nil, fmt.Errorf("%s: not an X25519 key", path) }
+		return xk.Bytes(), nil
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil { return nil, err }
+	xk, ok := k.(*ecdh.PublicKey)
+	if !ok { return nil, fmt.Errorf("%s: not an X25519 key", path) }
+	return xk.Bytes(), nil
+}
@@ -3,3 +3,8 @@ module github.com/japinder12/securefs-go
 go 1.20
 
 require github.com/google/uuid v1.6.0
+
+require (
+	golang.org/x/crypto v0.21.0
+	golang.org/x/sys v0.18.0 // indirect
+)
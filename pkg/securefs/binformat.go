@@ -0,0 +1,171 @@
+package securefs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Encoding selects the on-disk layout of a store file.
+type Encoding int
+
+const (
+	EncodingJSON   Encoding = iota // one JSON document, chunks base64'd
+	EncodingBinary                 // length-prefixed records, raw chunks
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingJSON:
+		return "json"
+	case EncodingBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("Encoding(%d)", int(e))
+}
+
+// ErrCorruptStore is returned when a binary store file fails to parse or a
+// record fails its checksum.
+var ErrCorruptStore = errors.New("corrupt store file")
+
+// The binary container is
+//
+//	magic    "SFSB" 0 0 0 1  (last byte is the container version)
+//	records  kind (1) | length (uvarint) | payload | CRC-32C of kind+payload (4, big-endian)
+//
+// Record kinds:
+//
+//	'M'  metadata: the Store minus its chunks, as JSON. Exactly one, first.
+//	'C'  chunk: 16-byte chunk ID followed by the raw ciphertext.
+//	'E'  end: uvarint number of chunk records. Must be last; its absence
+//	     means the file was truncated.
+//
+// Chunks are written in ID order so that equal stores encode identically.
+var binMagic = []byte("SFSB\x00\x00\x00\x01")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// storeMeta views a Store without its chunks. The outer Chunks field is
+// shallower than Store.Chunks, so it shadows it in JSON; being nil, it is
+// omitted.
+type storeMeta struct {
+	*Store
+	Chunks *struct{} `json:",omitempty"`
+}
+
+func isBinary(b []byte) bool {
+	return bytes.HasPrefix(b, binMagic[:4])
+}
+
+func encodeBinary(w io.Writer, s *Store) error {
+	bw := bufio.NewWriterSize(w, 1<<20)
+	if _, err := bw.Write(binMagic); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(storeMeta{Store: s})
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(bw, 'M', meta); err != nil {
+		return err
+	}
+	ids := sortedChunkIDs(s.Chunks)
+	for _, id := range ids {
+		if err := writeRecord(bw, 'C', id[:], s.Chunks[id]); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(bw, 'E', binary.AppendUvarint(nil, uint64(len(ids)))); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// sortedChunkIDs returns the chunk IDs in byte order.
+func sortedChunkIDs(chunks map[uuid.UUID][]byte) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(chunks))
+	for id := range chunks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	return ids
+}
+
+// writeRecord writes one record whose payload is the concatenation of parts.
+func writeRecord(w *bufio.Writer, kind byte, parts ...[]byte) error {
+	var n int
+	for _, p := range parts {
+		n += len(p)
+	}
+	hdr := binary.AppendUvarint([]byte{kind}, uint64(n))
+	sum := crc32.Update(0, castagnoli, hdr[:1])
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		sum = crc32.Update(sum, castagnoli, p)
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], sum)
+	_, err := w.Write(crc[:])
+	return err
+}
+
+// decodeBinary splits a binary store file into its metadata document and
+// chunks. Chunk slices alias b rather than copying it.
+func decodeBinary(b []byte) ([]byte, map[uuid.UUID][]byte, error) {
+	if !bytes.HasPrefix(b, binMagic) {
+		return nil, nil, fmt.Errorf("%w: unsupported container version", ErrCorruptStore)
+	}
+	p := b[len(binMagic):]
+	var meta []byte
+	chunks := make(map[uuid.UUID][]byte)
+	for {
+		if len(p) == 0 {
+			return nil, nil, fmt.Errorf("%w: truncated (no end record)", ErrCorruptStore)
+		}
+		kind := p[0]
+		n, k := binary.Uvarint(p[1:])
+		if k <= 0 || n > uint64(len(p)-1-k) || uint64(len(p)-1-k)-n < 4 {
+			return nil, nil, fmt.Errorf("%w: bad record length", ErrCorruptStore)
+		}
+		start := 1 + k
+		end := start + int(n)
+		payload := p[start:end:end] // cap-limited so appends never clobber the buffer
+		sum := crc32.Update(crc32.Update(0, castagnoli, p[:1]), castagnoli, payload)
+		if sum != binary.BigEndian.Uint32(p[end:end+4]) {
+			return nil, nil, fmt.Errorf("%w: checksum mismatch in %q record", ErrCorruptStore, kind)
+		}
+		p = p[end+4:]
+
+		switch {
+		case kind == 'M' && meta == nil:
+			meta = payload
+		case kind == 'C' && meta != nil && len(payload) >= 16:
+			id, _ := uuid.FromBytes(payload[:16])
+			chunks[id] = payload[16:]
+		case kind == 'E' && meta != nil:
+			count, k := binary.Uvarint(payload)
+			if k <= 0 || count != uint64(len(chunks)) {
+				return nil, nil, fmt.Errorf("%w: chunk count mismatch", ErrCorruptStore)
+			}
+			if len(p) != 0 {
+				return nil, nil, fmt.Errorf("%w: data after end record", ErrCorruptStore)
+			}
+			return meta, chunks, nil
+		default:
+			return nil, nil, fmt.Errorf("%w: unexpected %q record", ErrCorruptStore, kind)
+		}
+	}
+}
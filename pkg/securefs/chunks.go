@@ -0,0 +1,236 @@
+package securefs
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// chunkSize bounds the plaintext sealed into a single chunk, so random
+// access and rewrites only have to decrypt the part of a file they touch.
+const chunkSize = 64 << 10
+
+// splitChunks cuts data into pieces of at most chunkSize bytes.
+// Empty input yields no pieces.
+func splitChunks(data []byte) [][]byte {
+	var out [][]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		out = append(out, data[:n])
+		data = data[n:]
+	}
+	return out
+}
+
+// appendChunks encrypts data under rec.Key and appends the resulting
+// chunks to rec, keeping Offsets, Size, Hashes and Root in step.
+// Deduplicated records are cut at content-defined boundaries instead.
+// If sealing fails rec is left unchanged.
+func (s *Store) appendChunks(rec *fileRecord, data []byte) error {
+	pieces := splitChunks(data)
+	if rec.Dedup {
+		pieces = cdcChunks(gearTable(rec.Key), data)
+	}
+	ids := make([]uuid.UUID, 0, len(pieces))
+	for _, p := range pieces {
+		id, err := s.sealChunk(rec, rec.Key, rec.Dedup, p)
+		if err != nil {
+			s.releaseChunks(ids)
+			return err
+		}
+		ids = append(ids, id)
+	}
+	s.ref(ids)
+	for k, p := range pieces {
+		rec.Chunks = append(rec.Chunks, ids[k])
+		rec.Offsets = append(rec.Offsets, rec.Size)
+		rec.Hashes = append(rec.Hashes, contentHash(rec.Key, p))
+		rec.Size += int64(len(p))
+	}
+	rec.updateRoot()
+	return nil
+}
+
+// indexed reports whether rec carries per-chunk offsets and hashes.
+// Records written before those were tracked only have the chunk list.
+func (rec *fileRecord) indexed() bool {
+	return len(rec.Offsets) == len(rec.Chunks) && len(rec.Hashes) == len(rec.Chunks)
+}
+
+// reindex rebuilds Offsets, Size, Hashes and Root for a legacy record by
+// decrypting every chunk once.
+func (s *Store) reindex(rec *fileRecord) error {
+	offsets := make([]int64, 0, len(rec.Chunks))
+	hashes := make([][]byte, 0, len(rec.Chunks))
+	var size int64
+	for _, id := range rec.Chunks {
+		pt, err := s.openChunk(rec.Key, s.Chunks[id])
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, size)
+		hashes = append(hashes, contentHash(rec.Key, pt))
+		size += int64(len(pt))
+	}
+	rec.Offsets = offsets
+	rec.Hashes = hashes
+	rec.Size = size
+	rec.updateRoot()
+	return nil
+}
+
+// chunkAt returns the index of the chunk holding plaintext offset off,
+// or -1 if the record has no chunks. The caller ensures off < rec.Size.
+func chunkAt(offsets []int64, off int64) int {
+	return sort.Search(len(offsets), func(i int) bool { return offsets[i] > off }) - 1
+}
+
+// chunkLen returns the plaintext length of chunk i.
+func (rec *fileRecord) chunkLen(i int) int64 {
+	if i+1 < len(rec.Offsets) {
+		return rec.Offsets[i+1] - rec.Offsets[i]
+	}
+	return rec.Size - rec.Offsets[i]
+}
+
+// spliceChunks replaces chunks [i, j) of rec with freshly sealed chunks
+// holding data, drops the replaced chunks and shifts the offsets of the
+// chunks that follow. Chunks outside the range are left untouched.
+// Replacing every chunk (i == 0, j == len) is safe on unindexed records.
+func (s *Store) spliceChunks(rec *fileRecord, i, j int, data []byte) error {
+	var start int64
+	switch {
+	case i == 0:
+		// also covers whole-file replacement of legacy records
+	case i < len(rec.Chunks):
+		start = rec.Offsets[i]
+	default:
+		start = rec.Size
+	}
+	mid := &fileRecord{Key: rec.Key, Size: start}
+	mid.Dedup, mid.Compression, mid.Padding = rec.Dedup, rec.Compression, rec.Padding
+	if err := s.appendChunks(mid, data); err != nil {
+		return err
+	}
+
+	chunks := append([]uuid.UUID{}, rec.Chunks[:i]...)
+	chunks = append(chunks, mid.Chunks...)
+	offsets := append([]int64{}, rec.Offsets[:i]...)
+	offsets = append(offsets, mid.Offsets...)
+	hashes := append([][]byte{}, rec.Hashes[:i]...)
+	hashes = append(hashes, mid.Hashes...)
+	size := mid.Size
+	for k := j; k < len(rec.Chunks); k++ {
+		chunks = append(chunks, rec.Chunks[k])
+		offsets = append(offsets, size)
+		hashes = append(hashes, rec.Hashes[k])
+		size += rec.chunkLen(k)
+	}
+	old := rec.Chunks[i:j]
+	rec.Chunks, rec.Offsets, rec.Hashes, rec.Size = chunks, offsets, hashes, size
+	rec.updateRoot()
+	s.dropChunks(old)
+	return nil
+}
+
+// liveChunks returns every chunk ID rec still refers to: the current
+// list plus those of any retained versions.
+func (rec *fileRecord) liveChunks() map[uuid.UUID]bool {
+	live := make(map[uuid.UUID]bool, len(rec.Chunks))
+	for _, id := range rec.Chunks {
+		live[id] = true
+	}
+	if rec.History != nil {
+		for _, v := range rec.History.Versions {
+			for _, id := range v.Chunks {
+				live[id] = true
+			}
+		}
+	}
+	return live
+}
+
+// Every chunk list (a record's current list, a retained version, a
+// snapshot pin) counts as one reference to each chunk it names, in
+// Store.Refs. Whoever adds a list calls ref, whoever discards one calls
+// dropChunks, so releasing a chunk never has to look at the rest of the
+// store. Deduplicated chunks can be named by several lists, or several
+// times by one.
+
+// ref counts a new chunk list naming ids.
+func (s *Store) ref(ids []uuid.UUID) {
+	for _, id := range ids {
+		s.Refs[id]++
+	}
+}
+
+// unref discounts a chunk list naming ids.
+func (s *Store) unref(ids []uuid.UUID) {
+	for _, id := range ids {
+		if s.Refs[id]--; s.Refs[id] <= 0 {
+			delete(s.Refs, id)
+		}
+	}
+}
+
+// releaseChunks deletes those of ids no chunk list refers to.
+func (s *Store) releaseChunks(ids []uuid.UUID) {
+	for _, id := range ids {
+		if s.Refs[id] == 0 {
+			delete(s.Chunks, id)
+		}
+	}
+}
+
+// dropChunks discounts a discarded chunk list and deletes the chunks
+// nothing refers to any more.
+func (s *Store) dropChunks(ids []uuid.UUID) {
+	s.unref(ids)
+	s.releaseChunks(ids)
+}
+
+// refCounts counts the references to every chunk from scratch: each
+// record's current list and retained versions, and each snapshot pin.
+// OpenStore uses it for stores written before Refs was kept, and GC and
+// Check to recount.
+func (s *Store) refCounts() map[uuid.UUID]int {
+	refs := make(map[uuid.UUID]int, len(s.Chunks))
+	count := func(ids []uuid.UUID) {
+		for _, id := range ids {
+			refs[id]++
+		}
+	}
+	for _, rec := range s.Files {
+		if rec == nil {
+			continue
+		}
+		count(rec.Chunks)
+		if rec.History != nil {
+			for _, v := range rec.History.Versions {
+				count(v.Chunks)
+			}
+		}
+	}
+	for _, snap := range s.Snapshots {
+		for _, f := range snap.Files {
+			count(f.Chunks)
+		}
+	}
+	return refs
+}
+
+// readChunks decrypts and concatenates chunks [i, j) of rec.
+func (s *Store) readChunks(rec *fileRecord, i, j int) ([]byte, error) {
+	var out []byte
+	for _, id := range rec.Chunks[i:j] {
+		pt, err := s.openChunk(rec.Key, s.Chunks[id])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pt...)
+	}
+	return out, nil
+}
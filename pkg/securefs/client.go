@@ -1,6 +1,8 @@
 package securefs
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,12 +11,21 @@ import (
 	"github.com/google/uuid"
 )
 
+var errBadPassword = errors.New("bad password")
+
+// ErrStaleShare is returned by AcceptShare for a code issued before the
+// file was re-keyed.
+var ErrStaleShare = errors.New("share code is stale: the file has been re-keyed")
+
 // Client is a logged-in view for one user.
 type Client struct {
 	store     *Store
 	username  string
-	masterKey []byte
+	masterKey []byte // seals priv; the state key of the key schedule
+	holderKey []byte // keys holder tags
 	priv      *userPrivate
+	signer    *headSigner // signs the store's epoch heads as this user
+	unread    int         // inbox messages waiting at login, less those dismissed
 }
 
 func Signup(store *Store, username, password string) error {
@@ -24,19 +35,23 @@ func Signup(store *Store, username, password string) error {
 	if _, ok := store.Users[username]; ok {
 		return errors.New("user exists")
 	}
-	salt := RandomBytes(16)
-	mk := deriveKey([]byte(password), salt, []byte("master"), 32)
+	keys, err := store.newUserKeys()
+	if err != nil { return err }
 
-	priv := &userPrivate{FileIndex: map[string]uuid.UUID{}}
-	enc := symEnc(mk, must(json.Marshal(priv)))
+	kp, err := newKeyPair(store.random())
+	if err != nil { return err }
+	sk, err := signingKey(kp.Bytes())
+	if err != nil { return err }
 
-	rec := &userRecord{
-		Username: username,
-		Salt:     salt,
-		EncUser:  enc,
-	}
+	priv := &userPrivate{FileIndex: map[string]uuid.UUID{}, PrivateKey: kp.Bytes()}
+	enc, err := seal(store.random(), store.suite(), keys.state, must(json.Marshal(priv)), nil)
+	if err != nil { return err }
+
+	rec := &userRecord{Username: username, EncUser: enc, PublicKey: kp.PublicKey().Bytes(), SignKey: sk.Public().(ed25519.PublicKey), Tracked: true}
+	if err := store.wrapUserKeys(rec, password, keys); err != nil { return err }
 	return store.withWrite(func() error {
 		store.Users[username] = rec
+		store.signer = &headSigner{name: username, key: sk}
 		return nil
 	})
 }
@@ -46,45 +61,94 @@ func Login(store *Store, username, password string) (*Client, error) {
 	if !ok {
 		return nil, errors.New("no such user")
 	}
-	mk := deriveKey([]byte(password), rec.Salt, []byte("master"), 32)
-	pt, err := symDec(mk, rec.EncUser)
+	keys, err := store.unlock(rec, password)
+	if err != nil { return nil, err }
+	pt, err := openUserState(rec, keys.state)
 	if err != nil {
-		return nil, errors.New("bad password")
+		return nil, errBadPassword
 	}
 	var priv userPrivate
 	if err := json.Unmarshal(pt, &priv); err != nil {
 		return nil, err
 	}
-	return &Client{store: store, username: username, masterKey: mk, priv: &priv}, nil
+	c := &Client{store: store, username: username, masterKey: keys.state, holderKey: keys.holder, priv: &priv}
+	changed := c.registerHolders()
+	if !rec.Tracked {
+		rec.Tracked, changed = true, true
+	}
+	if rec.Schedule != scheduleWrapped {
+		// keys derived from the password can't be recovered; wrap them
+		if err := store.wrapUserKeys(rec, password, keys); err != nil { return nil, err }
+		changed = true
+	}
+	if priv.PrivateKey == nil {
+		// users from before key pairs get one now
+		kp, err := newKeyPair(store.random())
+		if err != nil { return nil, err }
+		priv.PrivateKey, rec.PublicKey = kp.Bytes(), kp.PublicKey().Bytes()
+		changed = true
+	}
+	sk, err := signingKey(priv.PrivateKey)
+	if err != nil { return nil, err }
+	pub := sk.Public().(ed25519.PublicKey)
+	switch {
+	case rec.SignKey == nil:
+		// users from before signed heads publish their key now
+		rec.SignKey, changed = pub, true
+	case !bytes.Equal(rec.SignKey, pub):
+		return nil, fmt.Errorf("%w: signing key of %s was replaced", ErrFork, username)
+	}
+	c.signer = &headSigner{name: username, key: sk}
+	// the store may be a copy from before this user's last save
+	if err := store.checkSigners(nil); err != nil { return nil, err }
+	if c.syncGroups() {
+		changed = true
+	}
+	if changed {
+		if err := c.persist(); err != nil { return nil, err }
+	}
+	msgs, err := c.Inbox()
+	if err != nil { return nil, err }
+	c.unread = len(msgs)
+	return c, nil
 }
 
 func (c *Client) persist() error {
 	rec := c.store.Users[c.username]
-	rec.EncUser = symEnc(c.masterKey, must(json.Marshal(c.priv)))
-	return c.store.Save()
+	enc, err := seal(c.store.random(), c.store.suite(), c.masterKey, must(json.Marshal(c.priv)), nil)
+	if err != nil { return err }
+	rec.EncUser = enc
+	return c.store.saveAs(c.signer)
 }
 
 func (c *Client) StoreFile(name string, data []byte) error {
-	key := deriveKey(c.masterKey, []byte(name), []byte("file-key"), 32)
-	root := uuid.New()
+	// Overwriting replaces the content of the existing record, so everyone
+	// holding the root (owner and collaborators) sees the new version.
+	if root, ok := c.priv.FileIndex[name]; ok {
+		if rec, ok := c.store.Files[root]; ok {
+			c.store.checkpoint(rec)
+			if err := c.store.spliceChunks(rec, 0, len(rec.Chunks), data); err != nil { return err }
+			return c.persist()
+		}
+	}
+	key, err := c.store.newKey()
+	if err != nil { return err }
+	root := c.store.newID()
 	// fresh record
-	rec := &fileRecord{Key: key, Chunks: []uuid.UUID{}}
-	// write first chunk
-	chID := uuid.New()
-	c.store.Chunks[chID] = symEnc(key, data)
-	rec.Chunks = append(rec.Chunks, chID)
+	rec := &fileRecord{Key: key, Chunks: []uuid.UUID{}, Offsets: []int64{}}
+	if err := c.store.escrowFileKey(root, rec, c.username, name); err != nil { return err }
+	if err := c.store.appendChunks(rec, data); err != nil { return err }
 	c.store.Files[root] = rec
-	c.priv.FileIndex[name] = root
+	c.bind(name, root)
 	return c.persist()
 }
 
 func (c *Client) LoadFile(name string) ([]byte, error) {
-	root, ok := c.priv.FileIndex[name]
-	if !ok { return nil, ErrNotFound }
-	rec := c.store.Files[root]
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
 	var out []byte
 	for _, id := range rec.Chunks {
-		pt, err := symDec(rec.Key, c.store.Chunks[id])
+		pt, err := c.store.openChunk(rec.Key, c.store.Chunks[id])
 		if err != nil { return nil, err }
 		out = append(out, pt...)
 	}
@@ -92,23 +156,24 @@ func (c *Client) LoadFile(name string) ([]byte, error) {
 }
 
 func (c *Client) AppendFile(name string, more []byte) error {
-	root, ok := c.priv.FileIndex[name]
-	if !ok { return ErrNotFound }
-	rec := c.store.Files[root]
-	chID := uuid.New()
-	c.store.Chunks[chID] = symEnc(rec.Key, more)
-	rec.Chunks = append(rec.Chunks, chID)
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return err }
+	}
+	c.store.checkpoint(rec)
+	if err := c.store.appendChunks(rec, more); err != nil { return err }
 	return c.persist()
 }
 
 func (c *Client) CreateShare(name string) (string, error) {
-	root, ok := c.priv.FileIndex[name]
-	if !ok { return "", ErrNotFound }
-	rec := c.store.Files[root]
+	root, rec, err := c.lookup(name)
+	if err != nil { return "", err }
 	code := ShareCode{File: root, Key: rec.Key}
 	msg := append([]byte("share|"), append(code.File[:], code.Key...)...)
 	code.Mac = hmacSHA256(c.store.Secret, msg)
-	b, _ := json.Marshal(code)
+	b, err := json.Marshal(code)
+	if err != nil { return "", err }
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
@@ -123,35 +188,136 @@ func (c *Client) AcceptShare(saveAs, code string) error {
 	}
 	rec, ok := c.store.Files[sc.File]
 	if !ok { return errors.New("dangling share") }
+	// the record's key is authoritative; a code for an older key grants nothing
+	if !hmacEqual(sc.Key, rec.Key) { return ErrStaleShare }
 	// adopt under new name
-	c.priv.FileIndex[saveAs] = sc.File
-	// ensure local can decrypt (use received key)
-	rec.Key = sc.Key
+	c.bind(saveAs, sc.File)
 	return c.persist()
 }
 
 func (c *Client) Revoke(name string) error {
+	root, _, err := c.lookup(name)
+	if err != nil { return err }
+	if err := c.rekey(root, name); err != nil { return err }
+	return c.persist()
+}
+
+// rekey rotates the key of the file at root, which the caller knows as
+// name, and re-encrypts all its chunks, including retained versions and
+// snapshot pins, and rehashes them since chunk hashes are keyed by it.
+// Escrow and group shares are resealed under the new key.
+func (c *Client) rekey(root uuid.UUID, name string) error {
+	r, err := c.prepareRekey(root, name)
+	if err != nil { return err }
+	c.store.commitRekey(r)
+	return nil
+}
+
+// rekeyed is a file re-encrypted under a new key but not switched over
+// yet: commitRekey installs it and abortRekey discards it. Only the new
+// chunks are in the store until then, so several files can be prepared
+// and then committed or abandoned together.
+type rekeyed struct {
+	root   uuid.UUID
+	key    []byte
+	escrow []byte
+	boxes  map[string][]byte // group -> share box under key
+	pins   []*frozenFile
+	remap  map[uuid.UUID]uuid.UUID
+	hashes map[uuid.UUID][]byte
+}
+
+// prepareRekey does every step of rekey that can fail.
+func (c *Client) prepareRekey(root uuid.UUID, name string) (*rekeyed, error) {
+	rec := c.store.Files[root]
+	newKey, err := c.store.newKey()
+	if err != nil { return nil, err }
+	r := &rekeyed{root: root, key: newKey, pins: c.store.pinsFor(root), remap: map[uuid.UUID]uuid.UUID{}, hashes: map[uuid.UUID][]byte{}}
+	ids := rec.liveChunks()
+	for _, p := range r.pins {
+		for _, id := range p.Chunks { ids[id] = true }
+	}
+	abort := func(err error) (*rekeyed, error) {
+		c.store.abortRekey(r)
+		return nil, err
+	}
+	for _, id := range sortedKeys(ids) {
+		pt, err := c.store.openChunk(rec.Key, c.store.Chunks[id])
+		if err != nil { return abort(err) }
+		newID, err := c.store.sealChunk(rec, newKey, isContentID(id), pt)
+		if err != nil { return abort(err) }
+		r.remap[id], r.hashes[id] = newID, contentHash(newKey, pt)
+	}
+	escrowed := &fileRecord{Key: newKey}
+	if err := c.store.escrowFileKey(root, escrowed, c.username, name); err != nil { return abort(err) }
+	r.escrow = escrowed.Escrow
+	if r.boxes, err = c.store.groupBoxes(root, newKey); err != nil { return abort(err) }
+	return r, nil
+}
+
+// abortRekey drops the chunks prepareRekey wrote; nothing refers to them.
+func (s *Store) abortRekey(r *rekeyed) {
+	for _, id := range r.remap { delete(s.Chunks, id) }
+}
+
+// commitRekey switches the file, its versions and pins to r's key and
+// chunks and releases the old chunks.
+func (s *Store) commitRekey(r *rekeyed) {
+	rec := s.Files[r.root]
+	rec.Key, rec.Escrow = r.key, r.escrow
+	for group, box := range r.boxes { s.Groups[group].Shares[r.root].Box = box }
+	rec.Hashes = rehashChunks(rec.Chunks, rec.Hashes, r.hashes)
+	rec.Chunks = s.remapChunks(rec.Chunks, r.remap)
+	rec.updateRoot()
+	if rec.History != nil {
+		for _, v := range rec.History.Versions {
+			v.Hashes = rehashChunks(v.Chunks, v.Hashes, r.hashes)
+			v.Chunks = s.remapChunks(v.Chunks, r.remap)
+		}
+	}
+	for _, p := range r.pins {
+		p.Key, p.Escrow = copyBytes(r.key), copyBytes(rec.Escrow)
+		p.Hashes = rehashChunks(p.Chunks, p.Hashes, r.hashes)
+		p.Chunks = s.remapChunks(p.Chunks, r.remap)
+	}
+	var old []uuid.UUID
+	for id := range r.remap { old = append(old, id) }
+	s.releaseChunks(old)
+}
+
+// Delete removes name from the caller's namespace. The file record stays
+// in place for anyone else it is shared with; once nothing refers to it,
+// Store.GC reclaims it. Users and groups the caller shared it with
+// through ShareWith get a file-deleted message.
+func (c *Client) Delete(name string) error {
 	root, ok := c.priv.FileIndex[name]
 	if !ok { return ErrNotFound }
-	rec := c.store.Files[root]
-	// rotate key and re-encrypt all chunks
-	newKey := deriveKey(c.masterKey, []byte(name), []byte("file-key|rotated|"+uuid.New().String()), 32)
-	var newChunks []uuid.UUID
-	for _, id := range rec.Chunks {
-		pt, err := symDec(rec.Key, c.store.Chunks[id])
-		if err != nil { return err }
-		newID := uuid.New()
-		c.store.Chunks[newID] = symEnc(newKey, pt)
-		newChunks = append(newChunks, newID)
-		// optionally delete old chunk
-		delete(c.store.Chunks, id)
-	}
-	rec.Key = newKey
-	rec.Chunks = newChunks
+	if err := c.notifyDeleted(name, root); err != nil { return err }
+	c.unbind(name)
 	return c.persist()
 }
 
 // ---- helpers ----
+// remapChunks returns ids renamed by m, moving their references along.
+func (s *Store) remapChunks(ids []uuid.UUID, m map[uuid.UUID]uuid.UUID) []uuid.UUID {
+	out := make([]uuid.UUID, len(ids))
+	for i, id := range ids { out[i] = m[id] }
+	s.unref(ids)
+	s.ref(out)
+	return out
+}
+
+// rehashChunks returns the hashes of ids from m, or hashes unchanged if
+// the list predates hash tracking.
+func rehashChunks(ids []uuid.UUID, hashes [][]byte, m map[uuid.UUID][]byte) [][]byte {
+	if len(hashes) != len(ids) {
+		return hashes
+	}
+	out := make([][]byte, len(ids))
+	for i, id := range ids { out[i] = m[id] }
+	return out
+}
+
 func must[T any](v T, err error) T {
 	if err != nil { panic(err) }
 	return v
@@ -0,0 +1,125 @@
+package securefs
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Codec selects how a file's chunks are encoded before they are sealed.
+type Codec byte
+
+const (
+	CodecNone    Codec = iota // plaintext as is
+	CodecDeflate              // DEFLATE (RFC 1951)
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecDeflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// ParseCodec is the inverse of Codec.String.
+func ParseCodec(s string) (Codec, error) {
+	for _, c := range []Codec{CodecNone, CodecDeflate} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", s)
+}
+
+// Chunks are sealed as an envelope
+//
+//	codec (1) | payload
+//
+// with chunkAD as associated data, so the codec tag is authenticated along
+// with the content and an envelope can never be mistaken for the raw
+// plaintext that chunks written before envelopes were sealed as (those
+// carry no associated data). A chunk is stored compressed only if that
+// makes it smaller, so the tag is per chunk, not per file.
+var chunkAD = []byte("securefs chunk v1")
+
+var errBadEnvelope = errors.New("malformed chunk envelope")
+
+// SetCompression sets the codec used for the named file's future writes.
+// Existing chunks keep the codec they were written with. Compressed sizes
+// depend on content, so leave sensitive files at CodecNone: an observer
+// who can influence part of a file can learn the rest from chunk lengths.
+func (c *Client) SetCompression(name string, codec Codec) error {
+	if codec != CodecNone && codec != CodecDeflate {
+		return fmt.Errorf("unknown codec %d", codec)
+	}
+	rec, err := c.record(name)
+	if err != nil { return err }
+	rec.Compression = codec
+	return c.persist()
+}
+
+// sealEnvelope encodes pt with codec, falling back to CodecNone if that
+// does not shrink it, pads the result per pad (nil for none) and seals it
+// under key with the store's suite.
+func (s *Store) sealEnvelope(key []byte, codec Codec, pad *PaddingPolicy, pt []byte) ([]byte, error) {
+	env := append([]byte{byte(CodecNone)}, pt...)
+	if codec == CodecDeflate {
+		var buf bytes.Buffer
+		buf.WriteByte(byte(CodecDeflate))
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil { return nil, err }
+		if _, err := w.Write(pt); err != nil { return nil, err }
+		if err := w.Close(); err != nil { return nil, err }
+		if buf.Len() < len(env) {
+			env = buf.Bytes()
+		}
+	}
+	return seal(s.random(), s.suite(), key, pad.pad(env), chunkAD)
+}
+
+// openChunk authenticates and decodes one chunk.
+func (s *Store) openChunk(key, ct []byte) ([]byte, error) {
+	env, err := open(key, ct, chunkAD, false)
+	if err != nil { return nil, err }
+	return decodeEnvelope(env)
+}
+
+// openLegacyChunk opens a chunk that may predate key commitment: an
+// envelope in a non-committing format, or raw plaintext sealed without
+// associated data as before envelopes. Only resealLegacyChunks uses it.
+func openLegacyChunk(key, ct []byte) ([]byte, error) {
+	if env, err := open(key, ct, chunkAD, true); err == nil {
+		return decodeEnvelope(env)
+	}
+	return open(key, ct, nil, true)
+}
+
+// decodeEnvelope strips padding and decodes an opened chunk envelope.
+func decodeEnvelope(env []byte) ([]byte, error) {
+	env, err := unpad(env)
+	if err != nil {
+		return nil, err
+	}
+	if len(env) == 0 {
+		return nil, errBadEnvelope
+	}
+	switch Codec(env[0]) {
+	case CodecNone:
+		return env[1:], nil
+	case CodecDeflate:
+		// never inflate past the largest chunk we write
+		r := flate.NewReader(bytes.NewReader(env[1:]))
+		pt, err := io.ReadAll(io.LimitReader(r, chunkSize+1))
+		if err != nil { return nil, err }
+		if len(pt) > chunkSize {
+			return nil, errBadEnvelope
+		}
+		return pt, nil
+	}
+	return nil, errBadEnvelope
+}
@@ -0,0 +1,69 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+)
+
+// CompactReport gives the on-disk size of the store before and after.
+type CompactReport struct {
+	Before int64
+	After  int64
+}
+
+// Compact rewrites the store into a fresh file in the binary encoding,
+// where chunks are raw bytes rather than base64 (about a third smaller
+// than the JSON every save writes), checks that the new file decodes back
+// to exactly the same contents, and only then renames it over the old
+// one. The store stays binary afterwards; SetEncoding(EncodingJSON) goes
+// back. A failed check leaves the original untouched. Run GC first to
+// also drop unreachable records and chunks.
+func (s *Store) Compact() (CompactReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rep CompactReport
+	if fi, err := os.Stat(s.path); err == nil {
+		rep.Before = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return rep, err
+	}
+
+	h := sha256.New()
+	err := replaceFile(s.path, func(w io.Writer) error {
+		return encodeBinary(io.MultiWriter(w, h), s)
+	}, func(tmp string) error {
+		return verifyCompacted(tmp, h.Sum(nil))
+	})
+	if err != nil { return rep, err }
+	s.encoding = EncodingBinary
+	fi, err := os.Stat(s.path)
+	if err != nil { return rep, err }
+	rep.After = fi.Size()
+	return rep, nil
+}
+
+// verifyCompacted checks that the file written at path hashes to sum, and
+// that decoding it as a store and encoding it again reproduces sum.
+func verifyCompacted(path string, sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil { return err }
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil { return err }
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return errors.New("compact: written file differs from encoded store")
+	}
+	fresh, err := OpenStore(path)
+	if err != nil { return err }
+	h.Reset()
+	if err := fresh.encodeTo(h); err != nil { return err }
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return errors.New("compact: store does not round-trip")
+	}
+	return nil
+}
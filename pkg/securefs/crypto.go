@@ -6,55 +6,230 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func RandomBytes(n int) []byte {
+// RandomBytes returns n bytes from crypto/rand.
+func RandomBytes(n int) ([]byte, error) {
+	return randomBytes(rand.Reader, n)
+}
+
+// randomBytes reads exactly n bytes from r. A short read is an error, so
+// a failing entropy source never yields predictable output.
+func randomBytes(r io.Reader, n int) ([]byte, error) {
 	b := make([]byte, n)
-	_, _ = rand.Read(b)
-	return b
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("read random bytes: %w", err)
+	}
+	return b, nil
+}
+
+// Suite names the AEAD a ciphertext was sealed with.
+type Suite byte
+
+const (
+	SuiteAESGCM            Suite = 1 // AES-256-GCM, 12-byte random nonces
+	SuiteXChaCha20Poly1305 Suite = 2 // XChaCha20-Poly1305, 24-byte random nonces
+)
+
+func (s Suite) String() string {
+	switch s {
+	case SuiteAESGCM:
+		return "aes-256-gcm"
+	case SuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	}
+	return fmt.Sprintf("Suite(%d)", int(s))
+}
+
+// ParseSuite is the inverse of Suite.String.
+func ParseSuite(name string) (Suite, error) {
+	for _, s := range []Suite{SuiteAESGCM, SuiteXChaCha20Poly1305} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// Ciphertexts carry a header naming their suite and committing to the
+// key:
+//
+//	magic (2) | version (1) | suite (1) | commitment (32) | nonce | AEAD ciphertext
+//
+// Neither AES-GCM nor XChaCha20-Poly1305 commits to its key: someone who
+// knows two keys can build one ciphertext that opens under both, to
+// different plaintexts. So seal never uses the caller's key K directly.
+// For each nonce it derives
+//
+//	commitment = HMAC-SHA256(K, "securefs key commitment" || prefix || nonce)
+//	AEAD key   = HMAC-SHA256(K, "securefs encryption key" || prefix || nonce)
+//
+// (prefix being the first four header bytes) and opening recomputes the
+// commitment before trying the AEAD. A second key would need an HMAC
+// collision to match it. The whole header is bound into the AEAD as
+// associated data, ahead of any caller-supplied associated data.
+//
+// Version 1 headers (no commitment) and headerless AES-GCM ciphertexts,
+// nonce first, are what earlier builds wrote. They are not committing,
+// so nothing reads them any more except the migration that reseals such
+// chunks (migrateV8) and the login of a user still on a password-derived
+// key schedule (openUserState).
+var ctMagic = [2]byte{0xa7, 0x5e}
+
+const (
+	ctVersion   = 2
+	ctPrefixLen = 4
+	ctHeaderLen = ctPrefixLen + sha256.Size
+)
+
+// keySize is the length of every symmetric key in the store.
+const keySize = 32
+
+var (
+	errKeySize       = errors.New("key must be 32 bytes")
+	errUnknownSuite  = errors.New("unknown cipher suite")
+	errNotCommitting = errors.New("ciphertext is not key-committing")
+	errKeyCommitment = errors.New("key does not match ciphertext commitment")
+)
+
+func newAEAD(suite Suite, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case SuiteAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, errUnknownSuite
+}
+
+// nonceSize is the nonce length suite's AEAD uses.
+func nonceSize(suite Suite) int {
+	if suite == SuiteXChaCha20Poly1305 {
+		return chacha20poly1305.NonceSizeX
+	}
+	return 12
+}
+
+// commitKeys derives the commitment and AEAD key for one ciphertext.
+func commitKeys(key, prefix, nonce []byte) (commitment, aeadKey []byte) {
+	ctx := append(append([]byte{}, prefix...), nonce...)
+	commitment = hmacSHA256(key, append([]byte("securefs key commitment"), ctx...))
+	aeadKey = hmacSHA256(key, append([]byte("securefs encryption key"), ctx...))
+	return commitment, aeadKey
+}
+
+// symDecAD opens a key-committing ciphertext from seal, with ad bound
+// into the tag.
+func symDecAD(key, ciphertext, ad []byte) ([]byte, error) {
+	return open(key, ciphertext, ad, false)
+}
+
+// seal encrypts under suite with a nonce read from rnd, a versioned header
+// and a key commitment.
+func seal(rnd io.Reader, suite Suite, key, plaintext, ad []byte) ([]byte, error) {
+	if len(key) != keySize {
+		return nil, errKeySize
+	}
+	prefix := []byte{ctMagic[0], ctMagic[1], ctVersion, byte(suite)}
+	nonce, err := randomBytes(rnd, nonceSize(suite))
+	if err != nil {
+		return nil, err
+	}
+	commitment, aeadKey := commitKeys(key, prefix, nonce)
+	aead, err := newAEAD(suite, aeadKey)
+	if err != nil {
+		return nil, err
+	}
+	hdr := append(prefix, commitment...)
+	out := append(append([]byte{}, hdr...), nonce...)
+	return aead.Seal(out, nonce, plaintext, append(hdr, ad...)), nil
+}
+
+// open authenticates and decrypts a ciphertext, dispatching on its
+// header. Non-committing formats are refused unless legacy is set.
+func open(key, ciphertext, ad []byte, legacy bool) ([]byte, error) {
+	hasMagic := len(ciphertext) >= ctPrefixLen && ciphertext[0] == ctMagic[0] && ciphertext[1] == ctMagic[1]
+	var pt []byte
+	var err error
+	switch {
+	case hasMagic && ciphertext[2] == ctVersion:
+		pt, err = openCommitted(key, ciphertext, ad)
+	case hasMagic && ciphertext[2] == 1 && legacy:
+		pt, err = openV1(key, ciphertext, ad)
+	case legacy:
+		return openLegacy(key, ciphertext, ad)
+	default:
+		return nil, errNotCommitting
+	}
+	if err != nil && legacy {
+		// a legacy nonce can start with the magic by chance
+		if pt, lerr := openLegacy(key, ciphertext, ad); lerr == nil {
+			return pt, nil
+		}
+	}
+	return pt, err
 }
 
-// deriveKey acts like HKDF-Expand over a PRK derived from password and salt.
-// This is for demo only.
-func deriveKey(password, salt, info []byte, length int) []byte {
-	prkMac := hmac.New(sha256.New, password)
-	prkMac.Write(salt)
-	prk := prkMac.Sum(nil)
-
-	var out []byte
-	var ctr uint32 = 1
-	for len(out) < length {
-		var ctrB [4]byte
-		binary.BigEndian.PutUint32(ctrB[:], ctr)
-		m := hmac.New(sha256.New, prk)
-		m.Write(info)
-		m.Write(ctrB[:])
-		out = append(out, m.Sum(nil)...)
-		ctr++
-	}
-	return out[:length]
+func openCommitted(key, ciphertext, ad []byte) ([]byte, error) {
+	if len(key) != keySize {
+		return nil, errKeySize
+	}
+	suite := Suite(ciphertext[3])
+	n := nonceSize(suite)
+	if len(ciphertext) < ctHeaderLen+n {
+		return nil, errors.New("ciphertext too short")
+	}
+	hdr := ciphertext[:ctHeaderLen:ctHeaderLen]
+	nonce := ciphertext[ctHeaderLen : ctHeaderLen+n]
+	commitment, aeadKey := commitKeys(key, hdr[:ctPrefixLen], nonce)
+	if !hmac.Equal(commitment, hdr[ctPrefixLen:]) {
+		return nil, errKeyCommitment
+	}
+	aead, err := newAEAD(suite, aeadKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext[ctHeaderLen+n:], append(hdr, ad...))
 }
 
-func symEnc(key, plaintext []byte) []byte {
-	// prepend random 12-byte nonce
-	nonce := RandomBytes(12)
-	block, _ := aes.NewCipher(key)
-	aead, _ := cipher.NewGCM(block)
-	ct := aead.Seal(nil, nonce, plaintext, nil)
-	return append(nonce, ct...)
+// openV1 opens the uncommitted header format: magic | 1 | suite | nonce | ct.
+func openV1(key, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(Suite(ciphertext[3]), key)
+	if err != nil {
+		return nil, err
+	}
+	body := ciphertext[ctPrefixLen:]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	hdr := ciphertext[:ctPrefixLen:ctPrefixLen]
+	return aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], append(hdr, ad...))
 }
 
-func symDec(key, ciphertext []byte) ([]byte, error) {
+func openLegacy(key, ciphertext, ad []byte) ([]byte, error) {
 	if len(ciphertext) < 12 {
 		return nil, errors.New("ciphertext too short")
 	}
 	nonce := ciphertext[:12]
 	ct := ciphertext[12:]
-	block, _ := aes.NewCipher(key)
-	aead, _ := cipher.NewGCM(block)
-	return aead.Open(nil, nonce, ct, nil)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ct, ad)
 }
 
 func hmacSHA256(key, msg []byte) []byte {
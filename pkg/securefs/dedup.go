@@ -0,0 +1,128 @@
+package securefs
+
+import (
+	"encoding/binary"
+
+	"github.com/google/uuid"
+)
+
+// Deduplicated files cut their content at content-defined boundaries and
+// name each chunk by a MAC of its plaintext under the file key, so the
+// same bytes written twice (a repeated append, an unchanged region of a
+// rewrite, a retained version) land on the same chunk and are stored
+// once. Boundaries come from a gear rolling hash whose table is also
+// keyed by the file key, so chunk sizes do not fingerprint known content
+// across files. Chunk IDs are version-8 UUIDs, which is how Revoke tells
+// them apart from random ones.
+//
+// Dedup is scoped to one file key: a chunk is sealed under the key of the
+// file that wrote it, so the same bytes in two files (even two of one
+// user's) are stored twice. Sharing them would take a key common to both
+// files for sealing and naming such chunks, and then sharing or revoking
+// one file would expose or re-key the other's content.
+
+const (
+	cdcMin  = 16 << 10
+	cdcMask = 1<<14 - 1 // about 16 KiB past cdcMin on average
+)
+
+// EnableDedup turns on content-defined chunking and deduplication for the
+// named file and re-chunks its current content. Retained versions and
+// snapshots keep their old chunks until they are dropped.
+func (c *Client) EnableDedup(name string) error {
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if rec.Dedup {
+		return nil
+	}
+	data, err := c.store.readChunks(rec, 0, len(rec.Chunks))
+	if err != nil { return err }
+	rec.Dedup = true
+	if err := c.store.spliceChunks(rec, 0, len(rec.Chunks), data); err != nil {
+		rec.Dedup = false
+		return err
+	}
+	return c.persist()
+}
+
+// DisableDedup makes later writes to the named file use fixed-size chunks
+// with random IDs again. Existing chunks are left as they are.
+func (c *Client) DisableDedup(name string) error {
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if !rec.Dedup {
+		return nil
+	}
+	rec.Dedup = false
+	return c.persist()
+}
+
+// sealChunk encodes and pads pt per rec's settings, encrypts it under key
+// into the store and returns its ID. With dedup the ID is derived from the
+// content and an existing chunk is reused instead of being sealed again.
+func (s *Store) sealChunk(rec *fileRecord, key []byte, dedup bool, pt []byte) (uuid.UUID, error) {
+	id := s.newID()
+	if dedup {
+		id = contentID(key, pt)
+		if _, ok := s.Chunks[id]; ok {
+			return id, nil
+		}
+	}
+	ct, err := s.sealEnvelope(key, rec.Compression, rec.Padding, pt)
+	if err != nil { return uuid.Nil, err }
+	s.Chunks[id] = ct
+	return id, nil
+}
+
+// contentID names a chunk by HMAC(key, "chunk-id|" || pt), truncated to a
+// version-8 UUID.
+func contentID(key, pt []byte) uuid.UUID {
+	var id uuid.UUID
+	copy(id[:], hmacSHA256(key, append([]byte("chunk-id|"), pt...)))
+	id[6] = id[6]&0x0f | 0x80
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
+
+func isContentID(id uuid.UUID) bool {
+	return id.Version() == 8
+}
+
+// gearTable derives the rolling-hash table for a file key.
+func gearTable(key []byte) *[256]uint64 {
+	var t [256]uint64
+	var ctr [4]byte
+	for i := 0; i < 256; i += 4 {
+		binary.BigEndian.PutUint32(ctr[:], uint32(i))
+		b := hmacSHA256(key, append([]byte("gear|"), ctr[:]...))
+		for k := 0; k < 4; k++ {
+			t[i+k] = binary.BigEndian.Uint64(b[8*k:])
+		}
+	}
+	return &t
+}
+
+// cdcChunks cuts data where the gear hash hits cdcMask, keeping pieces
+// between cdcMin and chunkSize bytes (the last may be shorter).
+func cdcChunks(gear *[256]uint64, data []byte) [][]byte {
+	var out [][]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > cdcMin {
+			if n > chunkSize {
+				n = chunkSize
+			}
+			var h uint64
+			for i := cdcMin; i < n; i++ {
+				h = h<<1 + gear[data[i]]
+				if h&cdcMask == 0 {
+					n = i + 1
+					break
+				}
+			}
+		}
+		out = append(out, data[:n])
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,318 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// ErrRollback is returned when a store is older than one this machine has
+// already seen: someone replaced it with a previous copy, or put older
+// contents under the epoch fields of the current one.
+var ErrRollback = errors.New("store rolled back to an earlier epoch")
+
+// ErrFork is returned when a store's history does not contain the head
+// this machine last saw, i.e. it was branched from an earlier copy, or
+// when the current head's signature does not verify.
+var ErrFork = errors.New("store history has forked")
+
+// headWindow is how many recent heads a store keeps. A client that was
+// away for more saves than this can still detect rollback, but not fork.
+const headWindow = 32
+
+// epochHead is one link of the store's hash chain. Heads saved by a
+// logged-in client are also signed by that user (see signHead), which
+// the store secret alone cannot forge.
+type epochHead struct {
+	Epoch     uint64
+	Head      []byte
+	Signer    string `json:",omitempty"` // user who saved it
+	UserState []byte `json:",omitempty"` // SHA-256 of the signer's EncUser as saved
+	Sig       []byte `json:",omitempty"` // Ed25519 over the above, see headMessage
+}
+
+// seenHead is what a state file remembers about a store: its newest head,
+// the digest of the contents saved under it, and the signing key of every
+// user whose signed head it has seen. Entries written before digests were
+// kept have none.
+type seenHead struct {
+	epochHead
+	Digest  []byte            `json:",omitempty"`
+	Signers map[string][]byte `json:",omitempty"` // user -> Ed25519 public key
+}
+
+// headSigner is the user a store signs its saves as.
+type headSigner struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+// advanceEpoch bumps the epoch and extends the chain with
+//
+//	head_n = HMAC(Secret, "epoch|" || head_{n-1} || n || nonce_n || digest_n)
+//
+// where digest_n is contentDigest of what is being saved, so a head
+// vouches for the store's users, files and chunks, not just its place in
+// the chain. The random nonce makes two writers that start from the same
+// copy end up with different heads, which is what exposes a fork.
+//
+// Secret is in the store, so anyone who can replace the file can extend
+// the chain from an old copy. What they cannot do is sign as a user: a
+// store with a signer signs the head with the user's Ed25519 key, derived
+// from their private key (signingKey), together with a hash of the
+// user's sealed state. Every client save reseals that state, so a copy
+// from before any signed save no longer matches the newest head its user
+// signed, however the chain is extended (checkSigners). The caller must
+// not change the store again before writing it.
+func (s *Store) advanceEpoch() error {
+	nonce, err := randomBytes(s.random(), 16)
+	if err != nil {
+		return err
+	}
+	digest, err := s.contentDigest()
+	if err != nil {
+		return err
+	}
+	s.Epoch++
+	s.Nonce = nonce
+	s.digest = digest
+	h := epochHead{Epoch: s.Epoch, Head: s.headFor(s.prevHead(), s.Epoch, s.Nonce, digest)}
+	if s.signer != nil {
+		h = s.signHead(h)
+	}
+	s.Heads = append(s.Heads, h)
+	if len(s.Heads) > headWindow {
+		s.Heads = append([]epochHead(nil), s.Heads[len(s.Heads)-headWindow:]...)
+	}
+	return nil
+}
+
+func (s *Store) headFor(prev []byte, epoch uint64, nonce, digest []byte) []byte {
+	msg := append([]byte("epoch|"), prev...)
+	msg = binary.BigEndian.AppendUint64(msg, epoch)
+	msg = append(msg, nonce...)
+	return hmacSHA256(s.Secret, append(msg, digest...))
+}
+
+// signHead signs h as the store's signer.
+func (s *Store) signHead(h epochHead) epochHead {
+	h.Signer = s.signer.name
+	h.UserState = userStateHash(s.Users[h.Signer])
+	h.Sig = ed25519.Sign(s.signer.key, s.headMessage(h))
+	return h
+}
+
+// headMessage is what a head's signature covers. Head and UserState are
+// fixed-size, so Signer can go last unprefixed.
+func (s *Store) headMessage(h epochHead) []byte {
+	msg := append([]byte("securefs epoch head|"), s.ID[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, h.Epoch)
+	msg = append(msg, h.Head...)
+	msg = append(msg, h.UserState...)
+	return append(msg, h.Signer...)
+}
+
+func userStateHash(rec *userRecord) []byte {
+	if rec == nil {
+		return nil
+	}
+	sum := sha256.Sum256(rec.EncUser)
+	return sum[:]
+}
+
+// checkSigners verifies the signature of every signed head in the window,
+// against pins (user -> key, from a state file) where it has one, and
+// checks that the newest head each user signed vouches for that user's
+// state as it is now. A store put back to a copy older than a user's last
+// save fails the second check even if its chain was extended since.
+func (s *Store) checkSigners(pins map[string][]byte) error {
+	newest := map[string]epochHead{}
+	for _, h := range s.Heads {
+		if h.Signer == "" {
+			continue
+		}
+		rec, ok := s.Users[h.Signer]
+		if !ok || len(rec.SignKey) != ed25519.PublicKeySize || !ed25519.Verify(rec.SignKey, s.headMessage(h), h.Sig) {
+			return fmt.Errorf("%w: signature on the head at epoch %d does not verify", ErrFork, h.Epoch)
+		}
+		if pin, ok := pins[h.Signer]; ok && !bytes.Equal(pin, rec.SignKey) {
+			return fmt.Errorf("%w: signing key of %s changed", ErrFork, h.Signer)
+		}
+		newest[h.Signer] = h
+	}
+	for _, user := range sortedKeys(newest) {
+		if h := newest[user]; !bytes.Equal(h.UserState, userStateHash(s.Users[user])) {
+			return fmt.Errorf("%w: state of %s is older than the save it signed at epoch %d", ErrRollback, user, h.Epoch)
+		}
+	}
+	return nil
+}
+
+// epochContent views a Store without its chunks and epoch fields. The
+// outer fields are shallower than the Store's, so they shadow them in
+// JSON; being nil, they are omitted.
+type epochContent struct {
+	*Store
+	Chunks *struct{} `json:",omitempty"`
+	Epoch  *struct{} `json:",omitempty"`
+	Nonce  *struct{} `json:",omitempty"`
+	Heads  *struct{} `json:",omitempty"`
+}
+
+// contentDigest hashes everything a save persists except the epoch
+// fields: the JSON of the rest of the store, then each chunk in ID order
+// as ID || length || ciphertext. It does not depend on the encoding.
+func (s *Store) contentDigest() ([]byte, error) {
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(epochContent{Store: s}); err != nil {
+		return nil, err
+	}
+	for _, id := range sortedChunkIDs(s.Chunks) {
+		h.Write(id[:])
+		binary.Write(h, binary.BigEndian, uint64(len(s.Chunks[id])))
+		h.Write(s.Chunks[id])
+	}
+	return h.Sum(nil), nil
+}
+
+// prevHead is the newest head before the current epoch.
+func (s *Store) prevHead() []byte {
+	if n := len(s.Heads); n > 0 && s.Heads[n-1].Epoch == s.Epoch-1 {
+		return s.Heads[n-1].Head
+	}
+	return nil
+}
+
+// headAt returns the head recorded for epoch, if still in the window.
+func (s *Store) headAt(epoch uint64) ([]byte, bool) {
+	for _, h := range s.Heads {
+		if h.Epoch == epoch {
+			return h.Head, true
+		}
+	}
+	return nil, false
+}
+
+// verifyHead checks that the current head is the signed successor of the
+// one before it and vouches for the store's current contents.
+func (s *Store) verifyHead() bool {
+	n := len(s.Heads)
+	if n == 0 {
+		return s.Epoch == 0
+	}
+	cur := s.Heads[n-1]
+	var prev []byte
+	if n > 1 {
+		prev = s.Heads[n-2].Head
+	}
+	digest, err := s.contentDigest()
+	if err != nil {
+		return false
+	}
+	return cur.Epoch == s.Epoch && hmacEqual(cur.Head, s.headFor(prev, s.Epoch, s.Nonce, digest))
+}
+
+// checkEpoch checks the loaded store's signed heads and compares it with
+// what the local state file remembers about it, then records the store's
+// current head. A store
+// just migrated from an older format carries a head signed without a
+// digest; it is not verified here, and the save that follows the
+// migration signs a new one.
+func (s *Store) checkEpoch(migrated bool) error {
+	if s.statePath == "" {
+		return nil
+	}
+	if !migrated && !s.verifyHead() {
+		return fmt.Errorf("%w: head signature does not verify", ErrFork)
+	}
+	digest, err := s.contentDigest()
+	if err != nil {
+		return err
+	}
+	s.digest = digest
+	state, err := loadEpochState(s.statePath)
+	if err != nil {
+		return err
+	}
+	seen, ok := state[s.ID]
+	if !migrated {
+		if err := s.checkSigners(seen.Signers); err != nil {
+			return err
+		}
+	}
+	if ok {
+		if s.Epoch < seen.Epoch {
+			return fmt.Errorf("%w: epoch %d, last seen %d", ErrRollback, s.Epoch, seen.Epoch)
+		}
+		head, ok := s.headAt(seen.Epoch)
+		if ok && !bytes.Equal(head, seen.Head) {
+			return fmt.Errorf("%w: head at epoch %d differs from the one last seen", ErrFork, seen.Epoch)
+		}
+		// the window always holds the last headWindow epochs, so a
+		// missing recent head means the chain was rewritten
+		if !ok && !migrated && s.Epoch-seen.Epoch < headWindow {
+			return fmt.Errorf("%w: head at epoch %d is missing", ErrFork, seen.Epoch)
+		}
+		// catches old contents under copied epoch fields even where the
+		// head was not verified (a store that claims an older format)
+		if s.Epoch == seen.Epoch && seen.Digest != nil && !bytes.Equal(digest, seen.Digest) {
+			return fmt.Errorf("%w: contents differ from those seen at epoch %d", ErrRollback, seen.Epoch)
+		}
+	}
+	return s.rememberEpoch()
+}
+
+// rememberEpoch records the store's current head in the local state file.
+func (s *Store) rememberEpoch() error {
+	if s.statePath == "" || len(s.Heads) == 0 {
+		return nil
+	}
+	state, err := loadEpochState(s.statePath)
+	if err != nil {
+		return err
+	}
+	pins := state[s.ID].Signers
+	for _, h := range s.Heads {
+		if rec, ok := s.Users[h.Signer]; ok && h.Signer != "" {
+			if pins == nil {
+				pins = map[string][]byte{}
+			}
+			if _, ok := pins[h.Signer]; !ok {
+				pins[h.Signer] = rec.SignKey
+			}
+		}
+	}
+	state[s.ID] = seenHead{epochHead: s.Heads[len(s.Heads)-1], Digest: s.digest, Signers: pins}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.statePath), 0o700); err != nil {
+		return err
+	}
+	return writeAtomic(s.statePath, writeBytes(b))
+}
+
+// loadEpochState reads the local state file: store ID -> newest head seen.
+func loadEpochState(path string) (map[uuid.UUID]seenHead, error) {
+	state := map[uuid.UUID]seenHead{}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("state file %s: %w", path, err)
+	}
+	return state, nil
+}
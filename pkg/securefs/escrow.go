@@ -0,0 +1,260 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Escrow splits a user's keys (the same secret a recovery code unwraps)
+// into Shamir shares, one sealed to each trustee's public key, so that
+// any threshold of them can restore the account after the password and
+// recovery codes are lost:
+//
+//  1. The user, locked out, calls RequestEscrowRecovery. This posts a
+//     fresh public key to their user record and hands back the matching
+//     private half, plus its fingerprint.
+//  2. The user tells each trustee the fingerprint out of band. A trustee
+//     who is satisfied it is really them calls ApproveEscrowRecovery with
+//     it; their share is opened and resealed to the request's key.
+//  3. With enough approvals, CompleteEscrowRecovery combines the shares,
+//     checks they open the account, and sets a new password.
+//
+// The store only ever holds shares sealed to trustees or to the request,
+// and the fingerprint check keeps someone who can write the store from
+// substituting a request key of their own.
+
+var (
+	ErrNoEscrow           = errors.New("no escrow set up")
+	ErrNotTrustee         = errors.New("not a trustee of this user")
+	ErrNoEscrowRequest    = errors.New("no pending escrow request")
+	ErrFingerprint        = errors.New("escrow request fingerprint mismatch")
+	ErrNotEnoughApprovals = errors.New("not enough trustee approvals")
+)
+
+// escrowRecord holds a user's escrowed shares.
+type escrowRecord struct {
+	Threshold int
+	Shares    map[string][]byte // trustee -> share sealed to their public key
+	Request   *escrowRequest    `json:",omitempty"`
+}
+
+// escrowRequest is a pending recovery.
+type escrowRequest struct {
+	PublicKey []byte
+	Time      time.Time
+	Approvals map[string][]byte // trustee -> share sealed to PublicKey
+}
+
+// EscrowRequest is the requester's half of a pending escrow recovery:
+// the private key approvals are sealed to. Keep it until the recovery is
+// complete; a new request replaces it.
+type EscrowRequest struct {
+	User        string
+	PrivateKey  []byte
+	Fingerprint string // what trustees compare before approving
+}
+
+// PendingEscrow describes an escrow request a trustee may approve.
+type PendingEscrow struct {
+	User        string
+	Fingerprint string
+	Time        time.Time
+	Approvals   int
+	Threshold   int
+	Approved    bool // the caller has approved it already
+}
+
+// SetupEscrow splits the caller's keys among trustees, any threshold of
+// whom can later restore access. Every trustee must have logged in at
+// least once so they have a public key. Calling it again replaces the
+// previous shares and cancels any pending request.
+func (c *Client) SetupEscrow(trustees []string, threshold int) error {
+	seen := map[string]bool{}
+	for _, t := range trustees {
+		if t == c.username || seen[t] {
+			return fmt.Errorf("invalid trustee %q", t)
+		}
+		seen[t] = true
+		rec, ok := c.store.Users[t]
+		if !ok {
+			return fmt.Errorf("no such user %q", t)
+		}
+		if rec.PublicKey == nil {
+			return fmt.Errorf("trustee %q has no public key yet; they must log in once", t)
+		}
+	}
+	keys := userKeys{state: c.masterKey, holder: c.holderKey}
+	parts, err := splitSecret(c.store.random(), keys.marshal(), len(trustees), threshold)
+	if err != nil { return err }
+	esc := &escrowRecord{Threshold: threshold, Shares: map[string][]byte{}}
+	for i, t := range trustees {
+		payload := append([]byte{parts[i].X}, parts[i].Y...)
+		box, err := c.store.sealTo(c.store.Users[t].PublicKey, payload, escrowShareAD(c.username, t))
+		if err != nil { return err }
+		esc.Shares[t] = box
+	}
+	c.store.Users[c.username].Escrow = esc
+	return c.persist()
+}
+
+// DisableEscrow drops the caller's escrowed shares.
+func (c *Client) DisableEscrow() error {
+	c.store.Users[c.username].Escrow = nil
+	return c.persist()
+}
+
+// Trustees returns the caller's trustees and threshold.
+func (c *Client) Trustees() ([]string, int) {
+	esc := c.store.Users[c.username].Escrow
+	if esc == nil {
+		return nil, 0
+	}
+	return sortedKeys(esc.Shares), esc.Threshold
+}
+
+// RequestEscrowRecovery starts recovering username's account through
+// their trustees, replacing any earlier request.
+func RequestEscrowRecovery(store *Store, username string) (*EscrowRequest, error) {
+	rec, ok := store.Users[username]
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	if rec.Escrow == nil {
+		return nil, ErrNoEscrow
+	}
+	kp, err := newKeyPair(store.random())
+	if err != nil {
+		return nil, err
+	}
+	pub := kp.PublicKey().Bytes()
+	err = store.withWrite(func() error {
+		rec.Escrow.Request = &escrowRequest{PublicKey: pub, Time: store.now(), Approvals: map[string][]byte{}}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EscrowRequest{User: username, PrivateKey: kp.Bytes(), Fingerprint: Fingerprint(pub)}, nil
+}
+
+// PendingEscrowRequests lists the requests the caller, as a trustee, can
+// approve, by user.
+func (c *Client) PendingEscrowRequests() []PendingEscrow {
+	var out []PendingEscrow
+	for _, name := range sortedKeys(c.store.Users) {
+		esc := c.store.Users[name].Escrow
+		if esc == nil || esc.Request == nil || esc.Shares[c.username] == nil {
+			continue
+		}
+		_, approved := esc.Request.Approvals[c.username]
+		out = append(out, PendingEscrow{
+			User:        name,
+			Fingerprint: Fingerprint(esc.Request.PublicKey),
+			Time:        esc.Request.Time,
+			Approvals:   len(esc.Request.Approvals),
+			Threshold:   esc.Threshold,
+			Approved:    approved,
+		})
+	}
+	return out
+}
+
+// ApproveEscrowRecovery releases the caller's share of username's keys to
+// their pending request, provided its fingerprint is the one the user
+// gave the caller out of band.
+func (c *Client) ApproveEscrowRecovery(username, fingerprint string) error {
+	rec, ok := c.store.Users[username]
+	if !ok || rec.Escrow == nil { return ErrNoEscrow }
+	box, ok := rec.Escrow.Shares[c.username]
+	if !ok { return ErrNotTrustee }
+	req := rec.Escrow.Request
+	if req == nil { return ErrNoEscrowRequest }
+	if normalizeCode(fingerprint) != normalizeCode(Fingerprint(req.PublicKey)) { return ErrFingerprint }
+	priv, err := c.privateKey()
+	if err != nil { return err }
+	payload, err := openFrom(priv, box, escrowShareAD(username, c.username))
+	if err != nil { return fmt.Errorf("open escrow share: %w", err) }
+	approval, err := c.store.sealTo(req.PublicKey, payload, escrowApprovalAD(username, c.username))
+	if err != nil { return err }
+	req.Approvals[c.username] = approval
+	return c.persist()
+}
+
+// CompleteEscrowRecovery combines the approved shares of req, sets
+// newPassword for the account and logs in. Recovery codes stay valid and
+// the shares stay in place for next time.
+func CompleteEscrowRecovery(store *Store, req *EscrowRequest, newPassword string) (*Client, error) {
+	if newPassword == "" {
+		return nil, errors.New("empty credentials")
+	}
+	rec, ok := store.Users[req.User]
+	if !ok || rec.Escrow == nil {
+		return nil, ErrNoEscrow
+	}
+	pending := rec.Escrow.Request
+	priv, err := ecdh.X25519().NewPrivateKey(req.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil || !bytes.Equal(pending.PublicKey, priv.PublicKey().Bytes()) {
+		return nil, ErrNoEscrowRequest
+	}
+	var parts []share
+	for _, t := range sortedKeys(pending.Approvals) {
+		payload, err := openFrom(priv, pending.Approvals[t], escrowApprovalAD(req.User, t))
+		if err != nil || len(payload) < 2 {
+			continue // a bad approval only counts against the threshold
+		}
+		parts = append(parts, share{X: payload[0], Y: payload[1:]})
+	}
+	if len(parts) < rec.Escrow.Threshold {
+		return nil, fmt.Errorf("%w: have %d of %d", ErrNotEnoughApprovals, len(parts), rec.Escrow.Threshold)
+	}
+	secret, err := combineShares(parts)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseUserKeys(secret)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := openUserState(rec, keys.state); err != nil {
+		return nil, fmt.Errorf("%w: shares do not open the account", errShares)
+	}
+	err = store.withWrite(func() error {
+		if err := store.wrapUserKeys(rec, newPassword, keys); err != nil {
+			return err
+		}
+		rec.Escrow.Request = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Login(store, req.User, newPassword)
+}
+
+// escrowShareAD binds a trustee's share to the user and trustee.
+func escrowShareAD(user, trustee string) []byte {
+	return escrowAD("securefs escrow share|", user, trustee)
+}
+
+// escrowApprovalAD binds a released share to the user and trustee.
+func escrowApprovalAD(user, trustee string) []byte {
+	return escrowAD("securefs escrow approval|", user, trustee)
+}
+
+// escrowAD length-prefixes each name, since usernames may contain any
+// separator: ("a|b", "c") and ("a", "b|c") must not share an AD.
+func escrowAD(label, user, trustee string) []byte {
+	ad := []byte(label)
+	for _, f := range []string{user, trustee} {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(len(f)))
+		ad = append(ad, f...)
+	}
+	return ad
+}
@@ -0,0 +1,289 @@
+package securefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// StoreFormat is the on-disk layout version this build reads and writes.
+// Stores without a Format field are version 0, the original layout.
+const StoreFormat = 9
+
+// ErrStoreTooNew is returned when a store was written by a newer build
+// whose layout this one does not understand.
+var ErrStoreTooNew = errors.New("store format is newer than this build supports")
+
+// migration upgrades a raw store document from format From to From+1.
+// Steps work on the undecoded top-level fields so they can reshape data
+// the current Store type could no longer unmarshal.
+type migration struct {
+	From  int
+	Apply func(doc map[string]json.RawMessage, s *Store) error
+}
+
+// migrations must hold exactly one step for each format below StoreFormat.
+var migrations = []migration{
+	{From: 0, Apply: migrateV0},
+	{From: 1, Apply: migrateV1},
+	{From: 2, Apply: migrateV2},
+	{From: 3, Apply: migrateV3},
+	{From: 4, Apply: migrateV4},
+	{From: 5, Apply: migrateV5},
+	{From: 6, Apply: migrateV6},
+	{From: 7, Apply: migrateV7},
+	{From: 8, Apply: migrateV8},
+}
+
+// migrateV0 stamps an original-layout store. Everything added since
+// (chunk offsets, holder tags, history, snapshots) is optional and filled
+// in lazily: offsets on first access, holders on each user's next login.
+func migrateV0(doc map[string]json.RawMessage, _ *Store) error {
+	if _, ok := doc["Snapshots"]; !ok {
+		doc["Snapshots"] = json.RawMessage("{}")
+	}
+	return nil
+}
+
+// migrateV1 gives the store the ID that clients' state files key their
+// remembered epochs by. The epoch itself starts at zero.
+func migrateV1(doc map[string]json.RawMessage, s *Store) error {
+	id, err := json.Marshal(s.newID())
+	if err != nil {
+		return err
+	}
+	doc["ID"] = id
+	return nil
+}
+
+// migrateV2 flags the store as possibly holding ciphertexts without a
+// key commitment, which new stores refuse. migrateV8 consumes the flag.
+func migrateV2(doc map[string]json.RawMessage, _ *Store) error {
+	doc["LegacyCiphertexts"] = json.RawMessage("true")
+	return nil
+}
+
+// migrateV3 flags the store as possibly holding users whose keys come
+// from the legacy derivation, which new stores refuse.
+func migrateV3(doc map[string]json.RawMessage, _ *Store) error {
+	doc["LegacyKeySchedule"] = json.RawMessage("true")
+	return nil
+}
+
+// migrateV4 only stamps the store: its epoch head was signed without a
+// content digest. checkEpoch skips that head, and the save that follows
+// every migration signs one with a digest.
+func migrateV4(doc map[string]json.RawMessage, _ *Store) error {
+	return nil
+}
+
+// migrateV5 drops the unkeyed chunk hashes and Merkle roots earlier
+// builds kept on records, versions and snapshot pins. Records without
+// hashes are reindexed, now keyed, on first access.
+func migrateV5(doc map[string]json.RawMessage, _ *Store) error {
+	var files map[string]map[string]json.RawMessage
+	if err := unmarshalField(doc, "Files", &files); err != nil {
+		return err
+	}
+	for _, rec := range files {
+		delete(rec, "Hashes")
+		delete(rec, "Root")
+		var history map[string]json.RawMessage
+		if err := unmarshalField(rec, "History", &history); err != nil {
+			return err
+		}
+		if history == nil {
+			continue
+		}
+		var versions []map[string]json.RawMessage
+		if err := unmarshalField(history, "Versions", &versions); err != nil {
+			return err
+		}
+		for _, v := range versions {
+			delete(v, "Hashes")
+		}
+		if err := marshalField(history, "Versions", versions); err != nil {
+			return err
+		}
+		if err := marshalField(rec, "History", history); err != nil {
+			return err
+		}
+	}
+	if err := marshalField(doc, "Files", files); err != nil {
+		return err
+	}
+
+	var snaps map[string]map[string]json.RawMessage
+	if err := unmarshalField(doc, "Snapshots", &snaps); err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		var pins map[string]map[string]json.RawMessage
+		if err := unmarshalField(snap, "Files", &pins); err != nil {
+			return err
+		}
+		for _, f := range pins {
+			delete(f, "Hashes")
+		}
+		if err := marshalField(snap, "Files", pins); err != nil {
+			return err
+		}
+	}
+	return marshalField(doc, "Snapshots", snaps)
+}
+
+// migrateV6 only stamps the store: from this format it keeps chunk
+// reference counts (Store.Refs), which OpenStore counts once for a store
+// that has none. The stamp keeps builds that would not update them from
+// writing the store.
+func migrateV6(doc map[string]json.RawMessage, _ *Store) error {
+	return nil
+}
+
+// migrateV7 only stamps the store: from this format saves by a logged-in
+// user carry that user's signature on the epoch head (see epoch.go), and
+// users publish a SignKey on their next login. The stamp keeps builds
+// that would write unsigned heads over signed ones from writing the store.
+func migrateV7(doc map[string]json.RawMessage, _ *Store) error {
+	return nil
+}
+
+// migrateV8 drops the LegacyCiphertexts flag, which anyone able to write
+// the file could set to make every read accept non-committing
+// ciphertexts again. A store that had it gets its chunks resealed in the
+// committing format once it is decoded (resealLegacyChunks).
+func migrateV8(doc map[string]json.RawMessage, s *Store) error {
+	var legacy bool
+	if err := unmarshalField(doc, "LegacyCiphertexts", &legacy); err != nil {
+		return err
+	}
+	s.resealLegacy = legacy
+	delete(doc, "LegacyCiphertexts")
+	return nil
+}
+
+// resealLegacyChunks reseals every chunk a file record, version or
+// snapshot pin refers to that does not open in the committing format,
+// under the same key and ID. Chunks that open under none of their keys
+// are left for Check to report.
+func (s *Store) resealLegacyChunks() error {
+	done := map[uuid.UUID]bool{}
+	reseal := func(key []byte, ids []uuid.UUID) error {
+		for _, id := range ids {
+			ct, ok := s.Chunks[id]
+			if !ok || done[id] {
+				continue
+			}
+			if _, err := s.openChunk(key, ct); err == nil {
+				done[id] = true
+				continue
+			}
+			pt, err := openLegacyChunk(key, ct)
+			if err != nil {
+				continue // perhaps under another record's key
+			}
+			if s.Chunks[id], err = s.sealEnvelope(key, CodecNone, nil, pt); err != nil {
+				return err
+			}
+			done[id] = true
+		}
+		return nil
+	}
+	for _, root := range sortedKeys(s.Files) {
+		rec := s.Files[root]
+		if rec == nil {
+			continue
+		}
+		if err := reseal(rec.Key, sortedKeys(rec.liveChunks())); err != nil {
+			return err
+		}
+	}
+	for _, id := range sortedKeys(s.Snapshots) {
+		snap := s.Snapshots[id]
+		if snap == nil {
+			continue
+		}
+		for _, root := range sortedKeys(snap.Files) {
+			if p := snap.Files[root]; p != nil {
+				if err := reseal(p.Key, p.Chunks); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalField decodes doc[key] into v, leaving v alone if the field is
+// absent or null.
+func unmarshalField(doc map[string]json.RawMessage, key string, v any) error {
+	raw, ok := doc[key]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// marshalField stores v as doc[key] if doc had that field.
+func marshalField(doc map[string]json.RawMessage, key string, v any) error {
+	if _, ok := doc[key]; !ok {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	doc[key] = raw
+	return nil
+}
+
+// upgrade brings the store document meta (the whole JSON file, or the
+// metadata record of a binary one) up to StoreFormat. If any step runs,
+// the original file bytes orig are first saved beside path as
+// path.v<N>.bak (an existing backup is never overwritten). It reports
+// whether meta changed.
+func (s *Store) upgrade(path string, orig, meta []byte) ([]byte, bool, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(meta, &doc); err != nil {
+		return nil, false, err
+	}
+	var from int
+	if raw, ok := doc["Format"]; ok {
+		if err := json.Unmarshal(raw, &from); err != nil {
+			return nil, false, fmt.Errorf("store format: %w", err)
+		}
+	}
+	switch {
+	case from < 0:
+		return nil, false, fmt.Errorf("%w: store format %d", ErrCorruptStore, from)
+	case from > StoreFormat:
+		return nil, false, fmt.Errorf("%w: file is format %d, this build reads up to %d", ErrStoreTooNew, from, StoreFormat)
+	case from == StoreFormat:
+		return meta, false, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		if err := writeAtomic(backup, writeBytes(orig)); err != nil {
+			return nil, false, fmt.Errorf("backup before migration: %w", err)
+		}
+	}
+	for v := from; v < StoreFormat; v++ {
+		m := migrations[v]
+		if m.From != v {
+			return nil, false, fmt.Errorf("no migration from store format %d", v)
+		}
+		if err := m.Apply(doc, s); err != nil {
+			return nil, false, fmt.Errorf("migrate store format %d: %w", v, err)
+		}
+	}
+	doc["Format"] = json.RawMessage(fmt.Sprint(StoreFormat))
+	out, err := json.Marshal(doc)
+	return out, true, err
+}
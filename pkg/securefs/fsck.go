@@ -0,0 +1,259 @@
+package securefs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Problem severities. Garbage is reclaimable by GC and harmless; anything
+// corrupt means data or metadata is missing or fails authentication.
+const (
+	SeverityGarbage = "garbage"
+	SeverityCorrupt = "corrupt"
+)
+
+// Problem kinds reported by Check.
+const (
+	ProblemBadSecret     = "bad-secret"       // store secret missing or wrong size
+	ProblemBadUser       = "bad-user"         // user record nil, misnamed or incomplete
+	ProblemBadFile       = "bad-file"         // file record nil or with a bad key
+	ProblemDanglingChunk = "dangling-chunk"   // chunk list names a chunk that is gone
+	ProblemBadOffsets    = "bad-offsets"      // offsets not monotonic or beyond size
+	ProblemOrphanChunk   = "orphan-chunk"     // chunk nothing refers to
+	ProblemUnreachable   = "unreachable-file" // record no index entry refers to
+	ProblemDanglingEntry = "dangling-entry"   // index or snapshot entry with no record
+	ProblemAuthFailure   = "auth-failure"     // chunk fails to decrypt
+	ProblemSizeMismatch  = "size-mismatch"    // decrypted size disagrees with offsets
+	ProblemBadEpoch      = "bad-epoch"        // current epoch head fails its signature
+	ProblemHashMismatch  = "hash-mismatch"    // content disagrees with its hash or Merkle root
+	ProblemBadRefcount   = "bad-refcount"     // kept chunk reference count is wrong; GC recounts
+)
+
+// Problem is one finding of an integrity check.
+type Problem struct {
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Subject  string `json:"subject"` // record, chunk, user or file name concerned
+	Detail   string `json:"detail,omitempty"`
+}
+
+// CheckReport is the machine-readable result of Store.Check or
+// Client.Check.
+type CheckReport struct {
+	Users    int       `json:"users"`
+	Files    int       `json:"files"`
+	Chunks   int       `json:"chunks"`
+	Verified int       `json:"verified"` // chunk lists decrypted and authenticated
+	Problems []Problem `json:"problems"`
+}
+
+// Corrupt reports whether any problem is worse than garbage.
+func (r *CheckReport) Corrupt() bool {
+	for _, p := range r.Problems {
+		if p.Severity == SeverityCorrupt {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CheckReport) add(sev, kind, subject, format string, args ...any) {
+	r.Problems = append(r.Problems, Problem{
+		Severity: sev,
+		Kind:     kind,
+		Subject:  subject,
+		Detail:   fmt.Sprintf(format, args...),
+	})
+}
+
+// Check validates the structure of the store without any credentials:
+// every chunk list (current, retained versions and snapshot pins) must
+// name existing chunks with consistent offsets, user records must be
+// complete, and chunks or records nothing reaches are reported as garbage.
+func (s *Store) Check() *CheckReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r := &CheckReport{Users: len(s.Users), Files: len(s.Files), Chunks: len(s.Chunks), Problems: []Problem{}}
+	if len(s.Secret) != 32 {
+		r.add(SeverityCorrupt, ProblemBadSecret, "store", "secret is %d bytes", len(s.Secret))
+	}
+	if !s.verifyHead() {
+		r.add(SeverityCorrupt, ProblemBadEpoch, "store", "epoch %d", s.Epoch)
+	}
+	for _, name := range sortedKeys(s.Users) {
+		u := s.Users[name]
+		switch {
+		case u == nil:
+			r.add(SeverityCorrupt, ProblemBadUser, name, "record is null")
+		case u.Username != name:
+			r.add(SeverityCorrupt, ProblemBadUser, name, "record names %q", u.Username)
+		case len(u.Salt) == 0 || len(u.EncUser) == 0:
+			r.add(SeverityCorrupt, ProblemBadUser, name, "missing salt or encrypted state")
+		}
+	}
+
+	sweep := s.holdersTracked()
+	referenced := map[uuid.UUID]bool{}
+	checkList := func(subject string, chunks []uuid.UUID, offsets []int64, size int64) {
+		for _, id := range chunks {
+			referenced[id] = true
+			if _, ok := s.Chunks[id]; !ok {
+				r.add(SeverityCorrupt, ProblemDanglingChunk, subject, "chunk %s missing", id)
+			}
+		}
+		if len(offsets) != len(chunks) {
+			return // predates offset tracking
+		}
+		var prev int64
+		for i, off := range offsets {
+			if (i == 0 && off != 0) || off < prev || off > size {
+				r.add(SeverityCorrupt, ProblemBadOffsets, subject, "offset %d of chunk %d", off, i)
+				return
+			}
+			prev = off
+		}
+	}
+	for _, root := range sortedKeys(s.Files) {
+		rec := s.Files[root]
+		subject := root.String()
+		if rec == nil {
+			r.add(SeverityCorrupt, ProblemBadFile, subject, "record is null")
+			continue
+		}
+		if len(rec.Key) != 32 {
+			r.add(SeverityCorrupt, ProblemBadFile, subject, "key is %d bytes", len(rec.Key))
+		}
+		if sweep && rec.unheld() {
+			r.add(SeverityGarbage, ProblemUnreachable, subject, "no index entry refers to it")
+		}
+		checkList(subject, rec.Chunks, rec.Offsets, rec.Size)
+		if rec.History != nil {
+			for _, v := range rec.History.Versions {
+				checkList(fmt.Sprintf("%s@v%d", subject, v.Version), v.Chunks, v.Offsets, v.Size)
+			}
+		}
+	}
+	for _, id := range sortedKeys(s.Snapshots) {
+		for _, root := range sortedKeys(s.Snapshots[id].Files) {
+			f := s.Snapshots[id].Files[root]
+			checkList(fmt.Sprintf("%s@snapshot:%s", root, id), f.Chunks, f.Offsets, f.Size)
+		}
+	}
+	counted := s.refCounts()
+	for _, id := range sortedKeys(counted) {
+		if s.Refs[id] != counted[id] {
+			r.add(SeverityCorrupt, ProblemBadRefcount, id.String(), "kept %d, counted %d", s.Refs[id], counted[id])
+		}
+	}
+	for _, id := range sortedKeys(s.Refs) {
+		if _, ok := counted[id]; !ok {
+			r.add(SeverityCorrupt, ProblemBadRefcount, id.String(), "kept %d, counted 0", s.Refs[id])
+		}
+	}
+	for _, id := range sortedKeys(s.Chunks) {
+		if !referenced[id] {
+			r.add(SeverityGarbage, ProblemOrphanChunk, id.String(), "%d bytes", len(s.Chunks[id]))
+		}
+	}
+	return r
+}
+
+// Check runs Store.Check and then decrypts and authenticates every chunk
+// list the caller can reach: each file in its index, the file's retained
+// versions, and each of the caller's snapshots.
+func (c *Client) Check() *CheckReport {
+	r := c.store.Check()
+
+	verify := func(subject string, key []byte, chunks []uuid.UUID, offsets []int64, size int64, hashes [][]byte) {
+		var total int64
+		for i, id := range chunks {
+			ct, ok := c.store.Chunks[id]
+			if !ok {
+				return // already reported as dangling
+			}
+			pt, err := c.store.openChunk(key, ct)
+			if err != nil {
+				r.add(SeverityCorrupt, ProblemAuthFailure, subject, "chunk %d (%s): %v", i, id, err)
+				return
+			}
+			if len(offsets) == len(chunks) && offsets[i] != total {
+				r.add(SeverityCorrupt, ProblemSizeMismatch, subject, "chunk %d starts at %d, recorded %d", i, total, offsets[i])
+				return
+			}
+			if len(hashes) == len(chunks) && !bytes.Equal(contentHash(key, pt), hashes[i]) {
+				r.add(SeverityCorrupt, ProblemHashMismatch, subject, "chunk %d (%s) does not match its hash", i, id)
+				return
+			}
+			total += int64(len(pt))
+		}
+		if len(offsets) == len(chunks) && total != size {
+			r.add(SeverityCorrupt, ProblemSizeMismatch, subject, "decrypted %d bytes, recorded %d", total, size)
+			return
+		}
+		r.Verified++
+	}
+
+	seen := map[uuid.UUID]bool{}
+	for _, name := range sortedKeys(c.priv.FileIndex) {
+		root := c.priv.FileIndex[name]
+		rec, ok := c.store.Files[root]
+		if !ok || rec == nil {
+			r.add(SeverityCorrupt, ProblemDanglingEntry, name, "file %s missing", root)
+			continue
+		}
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		verify(name, rec.Key, rec.Chunks, rec.Offsets, rec.Size, rec.Hashes)
+		if rec.indexed() && !bytes.Equal(merkleRoot(rec.leaves()), rec.Root) {
+			r.add(SeverityCorrupt, ProblemHashMismatch, name, "Merkle root does not match chunk hashes")
+		}
+		if rec.History != nil {
+			for _, v := range rec.History.Versions {
+				verify(fmt.Sprintf("%s@v%d", name, v.Version), rec.Key, v.Chunks, v.Offsets, v.Size, v.Hashes)
+			}
+		}
+	}
+	for _, label := range sortedKeys(c.priv.Snapshots) {
+		idx := c.priv.Snapshots[label]
+		snap, ok := c.store.Snapshots[idx.ID]
+		if !ok {
+			r.add(SeverityCorrupt, ProblemDanglingEntry, "snapshot:"+label, "snapshot %s missing", idx.ID)
+			continue
+		}
+		for _, name := range sortedKeys(idx.Files) {
+			f, ok := snap.Files[idx.Files[name]]
+			if !ok {
+				r.add(SeverityCorrupt, ProblemDanglingEntry, name+"@snapshot:"+label, "pin missing")
+				continue
+			}
+			verify(name+"@snapshot:"+label, f.Key, f.Chunks, f.Offsets, f.Size, f.Hashes)
+		}
+	}
+	return r
+}
+
+// sortedKeys returns m's keys in a stable order so reports are
+// reproducible. Each key is formatted once up front rather than on every
+// comparison.
+func sortedKeys[K interface{ ~string | uuid.UUID }, V any](m map[K]V) []K {
+	type entry struct {
+		str string
+		key K
+	}
+	entries := make([]entry, 0, len(m))
+	for k := range m {
+		entries = append(entries, entry{fmt.Sprint(k), k})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].str < entries[j].str })
+	keys := make([]K, len(entries))
+	for i, e := range entries {
+		keys[i] = e.key
+	}
+	return keys
+}
@@ -0,0 +1,179 @@
+package securefs
+
+import (
+	"bytes"
+
+	"github.com/google/uuid"
+)
+
+// GCReport describes what a collection found unreachable.
+type GCReport struct {
+	Files  int   // file records no index entry refers to
+	Chunks int   // chunks no live record, version or snapshot refers to
+	Bytes  int64 // ciphertext bytes held by those chunks
+	DryRun bool
+}
+
+// GC reclaims unreachable file records and chunks and persists the store.
+//
+// Users' file indexes are encrypted, so reachability comes from the holder
+// tags each index entry registers on its file record. Marking starts from
+// every record with a holder (plus records written before holders were
+// tracked, which are kept conservatively) and every snapshot; a live
+// record marks its current chunks and its retained versions.
+//
+// A user who has not logged in since holders were tracked may still have
+// index entries without tags, so an empty holder list proves nothing
+// until every user is Tracked: until then no record is collected.
+func (s *Store) GC() (GCReport, error) {
+	var rep GCReport
+	err := s.withWrite(func() error {
+		files, chunks := s.unreachable()
+		rep = s.report(files, chunks)
+		for _, root := range files {
+			delete(s.Files, root)
+		}
+		for _, id := range chunks {
+			delete(s.Chunks, id)
+		}
+		// recount rather than discount, which also repairs bad counts
+		s.Refs = s.refCounts()
+		return nil
+	})
+	return rep, err
+}
+
+// GCDryRun reports what GC would reclaim without changing the store.
+func (s *Store) GCDryRun() GCReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rep := s.report(s.unreachable())
+	rep.DryRun = true
+	return rep
+}
+
+func (s *Store) report(files, chunks []uuid.UUID) GCReport {
+	rep := GCReport{Files: len(files), Chunks: len(chunks)}
+	for _, id := range chunks {
+		rep.Bytes += int64(len(s.Chunks[id]))
+	}
+	return rep
+}
+
+// unreachable runs the mark phase and returns what the sweep would drop.
+func (s *Store) unreachable() (files, chunks []uuid.UUID) {
+	marked := map[uuid.UUID]bool{}
+	sweep := s.holdersTracked()
+	for root, rec := range s.Files {
+		if rec == nil {
+			continue // damaged; Check reports it
+		}
+		if sweep && rec.unheld() {
+			files = append(files, root)
+			continue
+		}
+		for id := range rec.liveChunks() {
+			marked[id] = true
+		}
+	}
+	for _, snap := range s.Snapshots {
+		if snap == nil {
+			continue
+		}
+		for _, f := range snap.Files {
+			if f == nil {
+				continue
+			}
+			for _, id := range f.Chunks {
+				marked[id] = true
+			}
+		}
+	}
+	for id := range s.Chunks {
+		if !marked[id] {
+			chunks = append(chunks, id)
+		}
+	}
+	return files, chunks
+}
+
+// holdersTracked reports whether every user's index entries have
+// registered their holder tags.
+func (s *Store) holdersTracked() bool {
+	for _, u := range s.Users {
+		if u != nil && !u.Tracked {
+			return false
+		}
+	}
+	return true
+}
+
+// unheld reports whether rec is tracked and no index entry holds it.
+func (rec *fileRecord) unheld() bool {
+	return rec.Holders != nil && len(rec.Holders) == 0
+}
+
+// holderTag is the opaque tag name's index entry registers on root. It is
+// keyed by the user's holder key, so it reveals neither user nor name.
+func (c *Client) holderTag(name string, root uuid.UUID) []byte {
+	return hmacSHA256(c.holderKey, append([]byte("holder|"+name+"|"), root[:]...))
+}
+
+// bind points name at root in the caller's index and registers the entry
+// on the record, first unbinding whatever name pointed at before.
+func (c *Client) bind(name string, root uuid.UUID) {
+	if old, ok := c.priv.FileIndex[name]; ok && old != root {
+		c.unbind(name)
+	}
+	c.priv.FileIndex[name] = root
+	if rec, ok := c.store.Files[root]; ok {
+		rec.addHolder(c.holderTag(name, root))
+	}
+}
+
+// unbind removes name from the caller's index and drops its holder tag.
+func (c *Client) unbind(name string) {
+	root, ok := c.priv.FileIndex[name]
+	if !ok {
+		return
+	}
+	delete(c.priv.FileIndex, name)
+	if rec, ok := c.store.Files[root]; ok {
+		rec.removeHolder(c.holderTag(name, root))
+	}
+}
+
+// registerHolders adds any missing holder tags for the caller's index,
+// covering entries made before holders were tracked. It reports whether
+// anything changed.
+func (c *Client) registerHolders() bool {
+	changed := false
+	for _, name := range sortedKeys(c.priv.FileIndex) {
+		root := c.priv.FileIndex[name]
+		if rec, ok := c.store.Files[root]; ok {
+			changed = rec.addHolder(c.holderTag(name, root)) || changed
+		}
+	}
+	return changed
+}
+
+func (rec *fileRecord) addHolder(tag []byte) bool {
+	for _, h := range rec.Holders {
+		if bytes.Equal(h, tag) {
+			return false
+		}
+	}
+	rec.Holders = append(rec.Holders, tag)
+	return true
+}
+
+func (rec *fileRecord) removeHolder(tag []byte) {
+	// keep the slice non-nil: an empty list means "tracked, no holders"
+	kept := [][]byte{}
+	for _, h := range rec.Holders {
+		if !bytes.Equal(h, tag) {
+			kept = append(kept, h)
+		}
+	}
+	rec.Holders = kept
+}
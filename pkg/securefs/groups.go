@@ -0,0 +1,341 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Groups let a file be shared with many users at once. A group has an
+// X25519 key pair; its private key is sealed to each member's public key,
+// and ShareWith seals a file's root key to the group's public key. Members
+// pick up group shares on login (or SyncGroups) and see them as
+// "group:<name>/<filename>".
+//
+// Removing a member rotates the group key pair and reseals every share to
+// the new one, so the removed member cannot open anything shared later.
+// With revokePrior, the files shared before are also re-keyed (as with
+// Revoke), and the former member's client drops them on its next sync.
+// Adding a member just seals the current group key to them: they see the
+// group's earlier shares too.
+
+var (
+	ErrNoGroup     = errors.New("no such group")
+	ErrNotMember   = errors.New("not a member of this group")
+	ErrNotOwner    = errors.New("only the group owner can change membership")
+	ErrShareTarget = errors.New(`share target must be "user:<name>" or "group:<name>"`)
+)
+
+// groupRecord is a group in the store.
+type groupRecord struct {
+	Owner     string
+	Epoch     int                       // bumped on every key rotation
+	PublicKey []byte                    // X25519
+	Members   map[string][]byte         // member -> group private key sealed to them
+	Shares    map[uuid.UUID]*groupShare // file root -> share
+	Revoked   map[string]bool           `json:",omitempty"` // former members who lost earlier shares too
+}
+
+// groupShare is one file shared with a group.
+type groupShare struct {
+	Name string // the sharer's name for the file
+	From string
+	Box  []byte // file key sealed to the group's public key
+}
+
+// GroupInfo describes a group the caller belongs to.
+type GroupInfo struct {
+	Name    string
+	Owner   string
+	Members []string
+	Files   int
+	Epoch   int
+}
+
+// CreateGroup creates a group owned by the caller, with the caller and
+// members in it. Every member must have logged in at least once so they
+// have a public key.
+func (c *Client) CreateGroup(name string, members []string) error {
+	if name == "" || strings.ContainsAny(name, "/:") {
+		return fmt.Errorf("invalid group name %q", name)
+	}
+	if _, ok := c.store.Groups[name]; ok {
+		return errors.New("group exists")
+	}
+	g := &groupRecord{Owner: c.username, Shares: map[uuid.UUID]*groupShare{}}
+	all := append([]string{c.username}, members...)
+	if err := c.store.rotateGroup(name, g, all, nil); err != nil { return err }
+	c.store.Groups[name] = g
+	return c.persist()
+}
+
+// AddGroupMember adds user to the caller's group.
+func (c *Client) AddGroupMember(group, user string) error {
+	g, err := c.ownedGroup(group)
+	if err != nil { return err }
+	if _, ok := g.Members[user]; ok {
+		return nil
+	}
+	priv, err := c.groupKey(group, g)
+	if err != nil { return err }
+	box, err := c.store.sealGroupKey(group, g.Epoch, user, priv)
+	if err != nil { return err }
+	g.Members[user] = box
+	delete(g.Revoked, user)
+	return c.persist()
+}
+
+// RemoveGroupMember removes user from the caller's group and rotates the
+// group key. With revokePrior, every file shared with the group so far is
+// re-keyed as well, and user's client drops those files on its next sync.
+// If any file cannot be re-keyed, or user cannot be told, nothing changes.
+func (c *Client) RemoveGroupMember(group, user string, revokePrior bool) error {
+	g, err := c.ownedGroup(group)
+	if err != nil { return err }
+	if _, ok := g.Members[user]; !ok { return ErrNotMember }
+	if user == g.Owner {
+		return errors.New("the owner cannot leave the group")
+	}
+	priv, err := c.groupKey(group, g)
+	if err != nil { return err }
+	// Re-key every file before switching any over, so a failure leaves
+	// the group and its files as they were.
+	keys := map[uuid.UUID][]byte{}
+	var rekeys []*rekeyed
+	abort := func(err error) error {
+		for _, r := range rekeys { c.store.abortRekey(r) }
+		return err
+	}
+	for _, root := range sortedKeys(g.Shares) {
+		if revokePrior {
+			if _, ok := c.store.Files[root]; !ok {
+				continue // collected; drop the share
+			}
+			r, err := c.prepareRekey(root, g.Shares[root].Name)
+			if err != nil { return abort(err) }
+			delete(r.boxes, group) // rotateGroup reseals it
+			rekeys = append(rekeys, r)
+			keys[root] = r.key
+			continue
+		}
+		k, err := openFrom(priv, g.Shares[root].Box, groupShareAD(group, root))
+		if err != nil { return fmt.Errorf("open group share: %w", err) }
+		keys[root] = k
+	}
+	var rest []string
+	for _, m := range sortedKeys(g.Members) {
+		if m != user {
+			rest = append(rest, m)
+		}
+	}
+	deliver, err := c.seal(user, InboxMessage{Kind: InboxAccessRevoked, Group: group})
+	if err != nil { return abort(err) }
+	if err := c.store.rotateGroup(group, g, rest, keys); err != nil { return abort(err) }
+	for _, r := range rekeys { c.store.commitRekey(r) }
+	if revokePrior {
+		if g.Revoked == nil {
+			g.Revoked = map[string]bool{}
+		}
+		g.Revoked[user] = true
+	}
+	deliver()
+	return c.persist()
+}
+
+// ShareWith shares the named file with target: "user:<name>" delivers a
+// capability code to that user's inbox, and "group:<name>" shares with a
+// group the caller belongs to and tells its other members.
+func (c *Client) ShareWith(name, target string) error {
+	if user, ok := strings.CutPrefix(target, "user:"); ok {
+		return c.shareWithUser(name, user)
+	}
+	group, ok := strings.CutPrefix(target, "group:")
+	if !ok { return ErrShareTarget }
+	g, ok := c.store.Groups[group]
+	if !ok { return ErrNoGroup }
+	if _, ok := g.Members[c.username]; !ok { return ErrNotMember }
+	root, rec, err := c.lookup(name)
+	if err != nil { return err }
+	box, err := c.store.sealTo(g.PublicKey, rec.Key, groupShareAD(group, root))
+	if err != nil { return err }
+	var deliver []func()
+	for _, m := range sortedKeys(g.Members) {
+		msg := InboxMessage{Kind: InboxShareReceived, Name: name, Group: group}
+		d, err := c.seal(m, msg)
+		if err != nil { return err }
+		deliver = append(deliver, d)
+	}
+	g.Shares[root] = &groupShare{Name: name, From: c.username, Box: box}
+	for _, d := range deliver { d() }
+	return c.persist()
+}
+
+// Groups lists the groups the caller belongs to.
+func (c *Client) Groups() []GroupInfo {
+	var out []GroupInfo
+	for _, name := range sortedKeys(c.store.Groups) {
+		g := c.store.Groups[name]
+		if _, ok := g.Members[c.username]; !ok {
+			continue
+		}
+		out = append(out, GroupInfo{Name: name, Owner: g.Owner, Members: sortedKeys(g.Members), Files: len(g.Shares), Epoch: g.Epoch})
+	}
+	return out
+}
+
+// SyncGroups binds files shared with the caller's groups that are not in
+// the caller's index yet, and drops ones whose access was revoked. Login
+// does this; long-lived clients can call it to catch up. It reports
+// whether the index changed.
+func (c *Client) SyncGroups() (bool, error) {
+	changed := c.syncGroups()
+	if !changed {
+		return false, nil
+	}
+	return true, c.persist()
+}
+
+func (c *Client) syncGroups() bool {
+	changed := false
+	for _, name := range sortedKeys(c.priv.GroupFiles) {
+		g, ok := c.store.Groups[c.priv.GroupFiles[name]]
+		if !ok || (g.Members[c.username] == nil && g.Revoked[c.username]) {
+			if _, bound := c.priv.FileIndex[name]; bound {
+				c.unbind(name)
+			}
+			delete(c.priv.GroupFiles, name)
+			changed = true
+		}
+	}
+	bound := map[uuid.UUID]bool{}
+	for _, root := range c.priv.FileIndex {
+		bound[root] = true
+	}
+	for _, group := range sortedKeys(c.store.Groups) {
+		g := c.store.Groups[group]
+		if _, ok := g.Members[c.username]; !ok {
+			continue
+		}
+		priv, err := c.groupKey(group, g)
+		if err != nil {
+			continue
+		}
+		for _, root := range sortedKeys(g.Shares) {
+			sh := g.Shares[root]
+			rec, ok := c.store.Files[root]
+			if !ok || bound[root] {
+				continue
+			}
+			// the box is the proof of access; it must carry the record's key
+			k, err := openFrom(priv, sh.Box, groupShareAD(group, root))
+			if err != nil || !bytes.Equal(k, rec.Key) {
+				continue
+			}
+			name := "group:" + group + "/" + sh.Name
+			if _, taken := c.priv.FileIndex[name]; taken {
+				continue
+			}
+			c.bind(name, root)
+			if c.priv.GroupFiles == nil {
+				c.priv.GroupFiles = map[string]string{}
+			}
+			c.priv.GroupFiles[name] = group
+			bound[root] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (c *Client) ownedGroup(group string) (*groupRecord, error) {
+	g, ok := c.store.Groups[group]
+	if !ok { return nil, ErrNoGroup }
+	if g.Owner != c.username { return nil, ErrNotOwner }
+	return g, nil
+}
+
+// groupKey opens the caller's copy of the group private key.
+func (c *Client) groupKey(group string, g *groupRecord) (*ecdh.PrivateKey, error) {
+	box, ok := g.Members[c.username]
+	if !ok { return nil, ErrNotMember }
+	me, err := c.privateKey()
+	if err != nil { return nil, err }
+	b, err := openFrom(me, box, groupKeyAD(group, g.Epoch, c.username))
+	if err != nil { return nil, fmt.Errorf("open group key: %w", err) }
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// rotateGroup gives g a fresh key pair sealed to members, and reseals the
+// file keys in keys (root -> key) to it. Shares not in keys are dropped.
+// g is only changed if every step succeeds.
+func (s *Store) rotateGroup(group string, g *groupRecord, members []string, keys map[uuid.UUID][]byte) error {
+	kp, err := newKeyPair(s.random())
+	if err != nil {
+		return err
+	}
+	epoch := g.Epoch + 1
+	boxes := map[string][]byte{}
+	for _, m := range members {
+		if _, dup := boxes[m]; dup {
+			return fmt.Errorf("duplicate member %q", m)
+		}
+		box, err := s.sealGroupKey(group, epoch, m, kp)
+		if err != nil {
+			return err
+		}
+		boxes[m] = box
+	}
+	shares := map[uuid.UUID]*groupShare{}
+	for _, root := range sortedKeys(keys) {
+		box, err := s.sealTo(kp.PublicKey().Bytes(), keys[root], groupShareAD(group, root))
+		if err != nil {
+			return err
+		}
+		sh := *g.Shares[root]
+		sh.Box = box
+		shares[root] = &sh
+	}
+	g.Epoch, g.PublicKey, g.Members, g.Shares = epoch, kp.PublicKey().Bytes(), boxes, shares
+	return nil
+}
+
+// sealGroupKey seals the group private key for epoch to user.
+func (s *Store) sealGroupKey(group string, epoch int, user string, priv *ecdh.PrivateKey) ([]byte, error) {
+	rec, ok := s.Users[user]
+	if !ok {
+		return nil, fmt.Errorf("no such user %q", user)
+	}
+	if rec.PublicKey == nil {
+		return nil, fmt.Errorf("member %q has no public key yet; they must log in once", user)
+	}
+	return s.sealTo(rec.PublicKey, priv.Bytes(), groupKeyAD(group, epoch, user))
+}
+
+// groupBoxes reseals key to every group the file at root is shared with.
+func (s *Store) groupBoxes(root uuid.UUID, key []byte) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	for _, group := range sortedKeys(s.Groups) {
+		g := s.Groups[group]
+		if _, ok := g.Shares[root]; !ok {
+			continue
+		}
+		box, err := s.sealTo(g.PublicKey, key, groupShareAD(group, root))
+		if err != nil {
+			return nil, err
+		}
+		out[group] = box
+	}
+	return out, nil
+}
+
+func groupKeyAD(group string, epoch int, member string) []byte {
+	return []byte(fmt.Sprintf("securefs group key|%s|%d|%s", group, epoch, member))
+}
+
+func groupShareAD(group string, root uuid.UUID) []byte {
+	return append([]byte("securefs group share|"+group+"|"), root[:]...)
+}
@@ -0,0 +1,183 @@
+package securefs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoVersion = errors.New("no such version")
+
+// record resolves name in the caller's index to its file record.
+func (c *Client) record(name string) (*fileRecord, error) {
+	_, rec, err := c.lookup(name)
+	return rec, err
+}
+
+// lookup resolves name in the caller's index to its root and file record.
+// A name whose record is gone (collected, or never restored) is
+// ErrNotFound like one that was never bound.
+func (c *Client) lookup(name string) (uuid.UUID, *fileRecord, error) {
+	root, ok := c.priv.FileIndex[name]
+	if !ok { return uuid.Nil, nil, ErrNotFound }
+	rec, ok := c.store.Files[root]
+	if !ok || rec == nil { return uuid.Nil, nil, ErrNotFound }
+	return root, rec, nil
+}
+
+// EnableHistory turns on version history for the named file, or replaces
+// its retention policy if history is already on. From then on every
+// StoreFile, AppendFile, WriteAt and Truncate first records the prior
+// state as a new version. History lives in the file record, so it is
+// shared with everyone the file is shared with.
+func (c *Client) EnableHistory(name string, policy RetentionPolicy) error {
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if rec.History == nil {
+		rec.History = &fileHistory{Next: 1}
+	}
+	rec.History.Policy = policy
+	c.store.pruneVersions(rec, c.store.now())
+	return c.persist()
+}
+
+// DisableHistory drops every retained version of the named file.
+func (c *Client) DisableHistory(name string) error {
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if rec.History == nil {
+		return nil
+	}
+	var dropped []uuid.UUID
+	for _, v := range rec.History.Versions {
+		dropped = append(dropped, v.Chunks...)
+	}
+	rec.History = nil
+	c.store.dropChunks(dropped)
+	return c.persist()
+}
+
+// ListVersions returns the retained versions of the named file, oldest
+// first. The current state is not a version.
+func (c *Client) ListVersions(name string) ([]VersionInfo, error) {
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
+	if rec.History == nil {
+		return nil, nil
+	}
+	out := make([]VersionInfo, 0, len(rec.History.Versions))
+	for _, v := range rec.History.Versions {
+		out = append(out, VersionInfo{Version: v.Version, Time: v.Time, Size: v.Size})
+	}
+	return out, nil
+}
+
+// LoadVersion returns the content of version v of the named file.
+func (c *Client) LoadVersion(name string, v int) ([]byte, error) {
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
+	ver := rec.version(v)
+	if ver == nil { return nil, ErrNoVersion }
+	return c.store.readChunks(&fileRecord{Key: rec.Key, Chunks: ver.Chunks}, 0, len(ver.Chunks))
+}
+
+// RestoreVersion makes version v the current content of the named file.
+// The state being replaced is itself recorded as a new version, so a
+// restore can be undone. No chunk data is copied.
+func (c *Client) RestoreVersion(name string, v int) error {
+	rec, err := c.record(name)
+	if err != nil { return err }
+	ver := rec.version(v)
+	if ver == nil { return ErrNoVersion }
+
+	now := c.store.now()
+	prev := rec.capture(now)
+	// the current list moves into prev; the restored one is a new list
+	c.store.ref(ver.Chunks)
+	rec.Chunks = append([]uuid.UUID{}, ver.Chunks...)
+	rec.Offsets = append([]int64{}, ver.Offsets...)
+	rec.Hashes = append([][]byte{}, ver.Hashes...)
+	rec.Size = ver.Size
+	rec.updateRoot()
+	rec.History.push(prev)
+	c.store.pruneVersions(rec, now)
+	return c.persist()
+}
+
+// PruneVersions applies the named file's retention policy now, without
+// waiting for the next write, and reports how many versions it dropped.
+func (c *Client) PruneVersions(name string) (int, error) {
+	rec, err := c.record(name)
+	if err != nil { return 0, err }
+	if rec.History == nil {
+		return 0, nil
+	}
+	n := c.store.pruneVersions(rec, c.store.now())
+	return n, c.persist()
+}
+
+func (rec *fileRecord) version(v int) *fileVersion {
+	if rec.History == nil {
+		return nil
+	}
+	for _, ver := range rec.History.Versions {
+		if ver.Version == v {
+			return ver
+		}
+	}
+	return nil
+}
+
+// capture returns rec's current chunk list as an unnumbered version.
+func (rec *fileRecord) capture(now time.Time) *fileVersion {
+	return &fileVersion{
+		Time:    now,
+		Chunks:  append([]uuid.UUID{}, rec.Chunks...),
+		Offsets: append([]int64{}, rec.Offsets...),
+		Size:    rec.Size,
+		Hashes:  append([][]byte{}, rec.Hashes...),
+	}
+}
+
+func (h *fileHistory) push(v *fileVersion) {
+	v.Version = h.Next
+	h.Next++
+	h.Versions = append(h.Versions, v)
+}
+
+// checkpoint records rec's current state as a new version before a
+// mutation, if history is enabled for it.
+func (s *Store) checkpoint(rec *fileRecord) {
+	if rec.History == nil {
+		return
+	}
+	now := s.now()
+	v := rec.capture(now)
+	s.ref(v.Chunks)
+	rec.History.push(v)
+	s.pruneVersions(rec, now)
+}
+
+// pruneVersions drops versions that fall outside rec's retention policy
+// and deletes chunks nothing else refers to. It returns the number of
+// versions dropped.
+func (s *Store) pruneVersions(rec *fileRecord, now time.Time) int {
+	h := rec.History
+	p := h.Policy
+	var keep []*fileVersion
+	var dropped []uuid.UUID
+	for i, v := range h.Versions {
+		tooMany := p.KeepVersions > 0 && len(h.Versions)-i > p.KeepVersions
+		tooOld := p.KeepFor > 0 && now.Sub(v.Time) > p.KeepFor
+		if tooMany || tooOld {
+			dropped = append(dropped, v.Chunks...)
+			continue
+		}
+		keep = append(keep, v)
+	}
+	n := len(h.Versions) - len(keep)
+	h.Versions = keep
+	s.dropChunks(dropped)
+	return n
+}
@@ -0,0 +1,174 @@
+package securefs
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Each user has an inbox in their user record: messages sealed to their
+// public key, so any client can deliver one without holding the
+// recipient's keys, and only the recipient can read them. The store sees
+// how many messages a user has, not what they say. From is whatever the
+// sender's client put there; share codes inside are still checked by
+// AcceptShare.
+
+var ErrNoMessage = errors.New("no such inbox message")
+
+// InboxKind says what an inbox message is about.
+type InboxKind string
+
+const (
+	InboxShareReceived InboxKind = "share-received" // Code to accept, or a group file now bound
+	InboxAccessRevoked InboxKind = "access-revoked" // removed from Group
+	InboxFileDeleted   InboxKind = "file-deleted"   // the sharer deleted Name
+)
+
+// InboxMessage is one event in a user's inbox.
+type InboxMessage struct {
+	ID    uuid.UUID
+	Kind  InboxKind
+	From  string
+	Time  time.Time
+	Name  string // the sender's name for the file
+	Group string `json:",omitempty"` // set for group events
+	Code  string `json:",omitempty"` // capability code for a direct share
+}
+
+// inboxEntry is a sealed InboxMessage.
+type inboxEntry struct {
+	ID  uuid.UUID
+	Box []byte
+}
+
+// Inbox returns the caller's undismissed messages, oldest first.
+// Messages that do not open are skipped.
+func (c *Client) Inbox() ([]InboxMessage, error) {
+	priv, err := c.privateKey()
+	if err != nil { return nil, err }
+	var out []InboxMessage
+	for _, e := range c.store.Users[c.username].Inbox {
+		b, err := openFrom(priv, e.Box, inboxAD(c.username))
+		if err != nil { continue }
+		var m InboxMessage
+		if err := json.Unmarshal(b, &m); err != nil || m.ID != e.ID { continue }
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// Unread reports how many inbox messages were waiting when the caller
+// logged in, less those dismissed since, so callers learn of shares and
+// revocations without polling Inbox.
+func (c *Client) Unread() int {
+	return c.unread
+}
+
+// Dismiss removes a message from the caller's inbox.
+func (c *Client) Dismiss(id uuid.UUID) error {
+	rec := c.store.Users[c.username]
+	for i, e := range rec.Inbox {
+		if e.ID == id {
+			rec.Inbox = append(rec.Inbox[:i:i], rec.Inbox[i+1:]...)
+			if c.unread > 0 {
+				c.unread--
+			}
+			return c.persist()
+		}
+	}
+	return ErrNoMessage
+}
+
+// AcceptFromInbox accepts the direct share in message id under saveAs
+// and dismisses the message.
+func (c *Client) AcceptFromInbox(id uuid.UUID, saveAs string) error {
+	msgs, err := c.Inbox()
+	if err != nil { return err }
+	for _, m := range msgs {
+		if m.ID != id {
+			continue
+		}
+		if m.Kind != InboxShareReceived || m.Code == "" {
+			return errors.New("message carries no share code")
+		}
+		if err := c.AcceptShare(saveAs, m.Code); err != nil { return err }
+		return c.Dismiss(id)
+	}
+	return ErrNoMessage
+}
+
+// notify delivers a message from the caller to user. Users without a
+// public key yet (created by older builds and not logged in since) are
+// skipped: there is nothing to seal to.
+func (c *Client) notify(user string, m InboxMessage) error {
+	deliver, err := c.seal(user, m)
+	if err != nil { return err }
+	deliver()
+	return nil
+}
+
+// seal encrypts m for user without touching the store, and returns the
+// step that delivers it, so callers can fail before committing a change
+// and deliver after.
+func (c *Client) seal(user string, m InboxMessage) (func(), error) {
+	rec, ok := c.store.Users[user]
+	if !ok || rec.PublicKey == nil || user == c.username {
+		return func() {}, nil
+	}
+	m.ID, m.From, m.Time = c.store.newID(), c.username, c.store.now()
+	b, err := json.Marshal(&m)
+	if err != nil { return nil, err }
+	box, err := c.store.sealTo(rec.PublicKey, b, inboxAD(user))
+	if err != nil { return nil, err }
+	return func() { rec.Inbox = append(rec.Inbox, &inboxEntry{ID: m.ID, Box: box}) }, nil
+}
+
+// inboxAD binds an inbox message to its recipient.
+func inboxAD(user string) []byte {
+	return []byte("securefs inbox|" + user)
+}
+
+// shareWithUser sends user a capability code for the named file.
+func (c *Client) shareWithUser(name, user string) error {
+	rec, ok := c.store.Users[user]
+	if !ok { return errors.New("no such user") }
+	if rec.PublicKey == nil { return errors.New("user has no public key yet; they must log in once") }
+	code, err := c.CreateShare(name)
+	if err != nil { return err }
+	if err := c.notify(user, InboxMessage{Kind: InboxShareReceived, Name: name, Code: code}); err != nil { return err }
+	root := c.priv.FileIndex[name]
+	if c.priv.Shared == nil {
+		c.priv.Shared = map[uuid.UUID][]string{}
+	}
+	for _, u := range c.priv.Shared[root] {
+		if u == user {
+			return c.persist()
+		}
+	}
+	c.priv.Shared[root] = append(c.priv.Shared[root], user)
+	return c.persist()
+}
+
+// notifyDeleted tells everyone the caller shared root with that it is
+// deleting it, and withdraws it from groups the caller shared it with.
+// Recipients who already bound the file keep it.
+func (c *Client) notifyDeleted(name string, root uuid.UUID) error {
+	for _, u := range c.priv.Shared[root] {
+		if err := c.notify(u, InboxMessage{Kind: InboxFileDeleted, Name: name}); err != nil { return err }
+	}
+	delete(c.priv.Shared, root)
+	for _, group := range sortedKeys(c.store.Groups) {
+		g := c.store.Groups[group]
+		if sh, ok := g.Shares[root]; !ok || sh.From != c.username {
+			continue
+		}
+		for _, m := range sortedKeys(g.Members) {
+			msg := InboxMessage{Kind: InboxFileDeleted, Name: name, Group: group}
+			if err := c.notify(m, msg); err != nil { return err }
+		}
+		delete(g.Shares, root)
+	}
+	return nil
+}
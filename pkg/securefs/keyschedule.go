@@ -0,0 +1,188 @@
+package securefs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key schedule
+//
+// Every key in a store is either random or derived with HKDF-SHA256 under
+// a label that names its one purpose. Each user has two random long-term
+// keys: the state key seals the user's private record (EncUser), and the
+// holder key keys the tags the user's index entries register on file
+// records (see holderTag). Both are sealed together (userKeys.marshal)
+// under a key derived from the password, and again under one derived
+// from each recovery code (see recovery.go):
+//
+//	password, salt --HKDF("securefs v1 password key")--> password key
+//	code, salt     --HKDF("securefs v1 recovery code key")--> code key
+//
+// so changing the password or recovering the account only rewraps them.
+// File keys, rotated file keys and the store secret are fresh random keys,
+// so re-storing a name never reuses a key. Below these, each ciphertext
+// derives its own commitment and AEAD key from the key it is sealed under
+// (commitKeys), and a file key derives its dedup content IDs and chunking
+// table (contentID, gearTable).
+//
+// Earlier builds derived the user keys from the password directly:
+// scheduleHKDF users have
+//
+//	password, salt --HKDF("securefs v1 user state key")--> state key
+//	password, salt --HKDF("securefs v1 holder tag key")--> holder key
+//
+// and scheduleLegacy users one "master" key from legacyDeriveKey doing
+// both jobs, which only stores migrated from those builds accept. Either
+// kind is moved to scheduleWrapped, keys unchanged, on its next login.
+const (
+	scheduleLegacy  = 0
+	scheduleHKDF    = 1
+	scheduleWrapped = 2
+)
+
+const (
+	labelUserState    = "securefs v1 user state key"
+	labelHolderTag    = "securefs v1 holder tag key"
+	labelPasswordKey  = "securefs v1 password key"
+	labelRecoveryCode = "securefs v1 recovery code key"
+)
+
+var errLegacySchedule = errors.New("legacy key schedule not allowed in this store")
+
+// userKeys are the keys a user's password unlocks.
+type userKeys struct {
+	state  []byte // seals userPrivate
+	holder []byte // keys holder tags
+}
+
+// newUserKeys returns fresh random user keys.
+func (s *Store) newUserKeys() (userKeys, error) {
+	state, err := s.newKey()
+	if err != nil {
+		return userKeys{}, err
+	}
+	holder, err := s.newKey()
+	if err != nil {
+		return userKeys{}, err
+	}
+	return userKeys{state: state, holder: holder}, nil
+}
+
+func (k userKeys) marshal() []byte {
+	return append(copyBytes(k.state), k.holder...)
+}
+
+func parseUserKeys(b []byte) (userKeys, error) {
+	if len(b) != 2*keySize {
+		return userKeys{}, errKeySize
+	}
+	return userKeys{state: copyBytes(b[:keySize]), holder: copyBytes(b[keySize:])}, nil
+}
+
+// userKeysAD binds wrapped user keys to the user they belong to.
+func userKeysAD(username string) []byte {
+	return []byte("securefs user keys|" + username)
+}
+
+// unlock recovers rec's user keys from its password.
+func (s *Store) unlock(rec *userRecord, password string) (userKeys, error) {
+	switch rec.Schedule {
+	case scheduleWrapped:
+		pk, err := hkdfKey([]byte(password), rec.Salt, labelPasswordKey, keySize)
+		if err != nil {
+			return userKeys{}, err
+		}
+		b, err := symDecAD(pk, rec.Wrapped, userKeysAD(rec.Username))
+		if err != nil {
+			return userKeys{}, errBadPassword
+		}
+		return parseUserKeys(b)
+	case scheduleLegacy:
+		if !s.LegacyKeySchedule {
+			return userKeys{}, errLegacySchedule
+		}
+	}
+	return deriveUserKeys(rec.Schedule, password, rec.Salt)
+}
+
+// wrapUserKeys seals keys under password with a fresh salt, moving rec
+// to scheduleWrapped. rec is only changed if every step succeeds.
+func (s *Store) wrapUserKeys(rec *userRecord, password string, keys userKeys) error {
+	salt, err := randomBytes(s.random(), 16)
+	if err != nil {
+		return err
+	}
+	pk, err := hkdfKey([]byte(password), salt, labelPasswordKey, keySize)
+	if err != nil {
+		return err
+	}
+	wrapped, err := seal(s.random(), s.suite(), pk, keys.marshal(), userKeysAD(rec.Username))
+	if err != nil {
+		return err
+	}
+	rec.Salt, rec.Schedule, rec.Wrapped = salt, scheduleWrapped, wrapped
+	return nil
+}
+
+// deriveUserKeys runs a key schedule that derives the user keys from the
+// password itself.
+func deriveUserKeys(schedule int, password string, salt []byte) (userKeys, error) {
+	switch schedule {
+	case scheduleLegacy:
+		mk := legacyDeriveKey([]byte(password), salt, []byte("master"), keySize)
+		return userKeys{state: mk, holder: mk}, nil
+	case scheduleHKDF:
+		state, err := hkdfKey([]byte(password), salt, labelUserState, keySize)
+		if err != nil {
+			return userKeys{}, err
+		}
+		holder, err := hkdfKey([]byte(password), salt, labelHolderTag, keySize)
+		if err != nil {
+			return userKeys{}, err
+		}
+		return userKeys{state: state, holder: holder}, nil
+	}
+	return userKeys{}, fmt.Errorf("unknown key schedule %d", schedule)
+}
+
+// hkdfKey is HKDF-SHA256 (RFC 5869) of secret and salt, expanded under
+// label to n bytes.
+func hkdfKey(secret, salt []byte, label string, n int) ([]byte, error) {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(label)), out); err != nil {
+		return nil, fmt.Errorf("hkdf %q: %w", label, err)
+	}
+	return out, nil
+}
+
+// newKey returns a fresh random symmetric key.
+func (s *Store) newKey() ([]byte, error) {
+	return randomBytes(s.random(), keySize)
+}
+
+// legacyDeriveKey is the HKDF-like construction earlier builds derived
+// master keys with. Only used to log in users created by those builds.
+func legacyDeriveKey(password, salt, info []byte, length int) []byte {
+	prkMac := hmac.New(sha256.New, password)
+	prkMac.Write(salt)
+	prk := prkMac.Sum(nil)
+
+	var out []byte
+	var ctr uint32 = 1
+	for len(out) < length {
+		var ctrB [4]byte
+		binary.BigEndian.PutUint32(ctrB[:], ctr)
+		m := hmac.New(sha256.New, prk)
+		m.Write(info)
+		m.Write(ctrB[:])
+		out = append(out, m.Sum(nil)...)
+		ctr++
+	}
+	return out[:length]
+}
@@ -0,0 +1,262 @@
+package securefs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Each file record commits to its content with a Merkle tree in the shape
+// of RFC 9162 (Certificate Transparency): leaves are
+//
+//	SHA-256(0x00 || offset (8 bytes, big-endian) || HMAC(Kf, "chunk-hash|" || chunk plaintext))
+//
+// and interior nodes SHA-256(0x01 || left || right). Binding the offset
+// into each leaf means a proof fixes where the chunk's bytes sit in the
+// file. The record keeps the per-chunk content hashes, so the root can be
+// recomputed after any write without decrypting anything. The hashes are
+// keyed by the file key because they sit in the clear next to the
+// ciphertext: unkeyed, anyone reading the store could confirm a guess at
+// a chunk's content. Rotating the key (Revoke) rehashes every chunk, so
+// the root changes with it.
+
+// ErrBadProof is returned when a range proof does not verify.
+var ErrBadProof = errors.New("range proof does not verify")
+
+// RangeProof carries bytes read from a file together with what a verifier
+// needs to check them against the file's Merkle root.
+type RangeProof struct {
+	Offset int64        // file offset of Data
+	Data   []byte       // the requested bytes
+	Leaves int          // number of chunks in the file (tree size)
+	Chunks []ChunkProof // every chunk overlapping the range, in order
+}
+
+// ChunkProof is one chunk's plaintext and its inclusion path.
+type ChunkProof struct {
+	Index     int
+	Offset    int64
+	Plaintext []byte
+	Path      [][]byte
+}
+
+// contentHash is a chunk's keyed content hash.
+func contentHash(key, pt []byte) []byte {
+	return hmacSHA256(key, append([]byte("chunk-hash|"), pt...))
+}
+
+func leafHash(off int64, content []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	binary.Write(h, binary.BigEndian, off)
+	h.Write(content)
+	return h.Sum(nil)
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// leaves returns the record's leaf hashes, or nil if it is not indexed.
+func (rec *fileRecord) leaves() [][]byte {
+	if !rec.indexed() {
+		return nil
+	}
+	out := make([][]byte, len(rec.Chunks))
+	for i := range out {
+		out[i] = leafHash(rec.Offsets[i], rec.Hashes[i])
+	}
+	return out
+}
+
+// updateRoot recomputes rec.Root, or clears it if rec is not indexed.
+func (rec *fileRecord) updateRoot() {
+	if !rec.indexed() {
+		rec.Root = nil
+		return
+	}
+	rec.Root = merkleRoot(rec.leaves())
+}
+
+// split returns the largest power of two smaller than n (n > 1).
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	return nodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// auditPath returns the inclusion path for leaf m, bottom-up.
+func auditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := split(len(leaves))
+	if m < k {
+		return append(auditPath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(auditPath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// verifyInclusion checks that leaf sits at index in a tree of size n with
+// the given root (RFC 9162, section 2.1.3.2).
+func verifyInclusion(index, n int, leaf []byte, path [][]byte, root []byte) bool {
+	if index < 0 || index >= n {
+		return false
+	}
+	fn, sn := index, n-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// MerkleRoot returns the named file's Merkle root.
+func (c *Client) MerkleRoot(name string) ([]byte, error) {
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return nil, err }
+	}
+	return copyBytes(rec.Root), nil
+}
+
+// ReadRange reads n bytes at off from the named file and returns them
+// with inclusion proofs for every chunk they touch. The reply can be
+// checked with VerifyRange against the file's MerkleRoot by anyone who
+// holds the file.
+func (c *Client) ReadRange(name string, off, n int64) (*RangeProof, error) {
+	if off < 0 || n < 0 {
+		return nil, errors.New("negative range")
+	}
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return nil, err }
+	}
+	if off > rec.Size || n > rec.Size-off {
+		return nil, errors.New("range beyond end of file")
+	}
+	p := &RangeProof{Offset: off, Data: []byte{}, Leaves: len(rec.Chunks)}
+	if n == 0 {
+		return p, nil // includes every read of an empty file
+	}
+	leaves := rec.leaves()
+	for i := chunkAt(rec.Offsets, off); i < len(rec.Chunks) && rec.Offsets[i] < off+n; i++ {
+		pt, err := c.store.openChunk(rec.Key, c.store.Chunks[rec.Chunks[i]])
+		if err != nil { return nil, err }
+		p.Chunks = append(p.Chunks, ChunkProof{
+			Index:     i,
+			Offset:    rec.Offsets[i],
+			Plaintext: pt,
+			Path:      auditPath(i, leaves),
+		})
+	}
+	var all []byte
+	for _, ch := range p.Chunks {
+		all = append(all, ch.Plaintext...)
+	}
+	if len(p.Chunks) == 0 || off-p.Chunks[0].Offset+n > int64(len(all)) {
+		return nil, errors.New("chunk offsets do not match the file size")
+	}
+	start := off - p.Chunks[0].Offset
+	p.Data = all[start : start+n]
+	return p, nil
+}
+
+// VerifyRange checks a RangeProof for the named file against its Merkle
+// root: every chunk must be included at its stated index and offset, the
+// chunks must be contiguous, and Data must be exactly their bytes at
+// Offset. Leaves are keyed, so checking needs the file's current key.
+func (c *Client) VerifyRange(name string, root []byte, p *RangeProof) error {
+	rec, err := c.record(name)
+	if err != nil { return err }
+	return verifyRange(rec.Key, root, p)
+}
+
+func verifyRange(key, root []byte, p *RangeProof) error {
+	if len(p.Data) == 0 {
+		return nil
+	}
+	if len(p.Chunks) == 0 {
+		return ErrBadProof
+	}
+	var all []byte
+	for k, ch := range p.Chunks {
+		if k > 0 {
+			prev := p.Chunks[k-1]
+			if ch.Index != prev.Index+1 || ch.Offset != prev.Offset+int64(len(prev.Plaintext)) {
+				return ErrBadProof
+			}
+		}
+		leaf := leafHash(ch.Offset, contentHash(key, ch.Plaintext))
+		if !verifyInclusion(ch.Index, p.Leaves, leaf, ch.Path, root) {
+			return ErrBadProof
+		}
+		all = append(all, ch.Plaintext...)
+	}
+	start := p.Offset - p.Chunks[0].Offset
+	if start < 0 || start+int64(len(p.Data)) > int64(len(all)) || !bytes.Equal(all[start:start+int64(len(p.Data))], p.Data) {
+		return ErrBadProof
+	}
+	return nil
+}
+
+// FileDigest returns a commitment to the named file's content that is the
+// same for any two files with identical bytes, whoever stores them and
+// however they were written: the Merkle root the content would have if
+// cut into whole chunkSize pieces, with chunk hashes keyed by key instead
+// of the file key. Users who want to compare files agree on key out of
+// band; to anyone without it the digest reveals nothing, not even
+// equality. The content is decrypted and rehashed.
+//
+// It takes key where a plain FileDigest(name) would use a fixed hash:
+// an unkeyed digest lets whoever sees it confirm a guess of the content
+// offline, the leak that made chunk hashes keyed (contentHash), while the
+// file key cannot serve since it differs between the files compared.
+func (c *Client) FileDigest(name string, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty digest key")
+	}
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
+	data, err := c.store.readChunks(rec, 0, len(rec.Chunks))
+	if err != nil { return nil, err }
+	var leaves [][]byte
+	for i, p := range splitChunks(data) {
+		leaves = append(leaves, leafHash(int64(i)*chunkSize, contentHash(key, p)))
+	}
+	return merkleRoot(leaves), nil
+}
@@ -0,0 +1,156 @@
+package securefs
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Organization escrow is a store-wide compliance policy: while
+// Store.OrgEscrow is set, every new file key (on StoreFile of a new name,
+// and on Revoke) is also sealed to the policy's public key, together with
+// the creating user and filename. Whoever holds the matching private key
+// can then decrypt those files offline from the store alone, with
+// OrgEscrowDecrypt. The policy is a plain field of the store and each
+// escrowed record says so (FileInfo.Escrowed), so users can always see it.
+//
+// Setting a policy does not reach back: files keyed before it stay out of
+// escrow until their key is next rotated. Clearing it stops new keys
+// from being escrowed but leaves existing wraps in place; Revoke rotates
+// a file's key out of them.
+
+var ErrNotEscrowed = errors.New("file key is not escrowed to this key")
+
+// OrgEscrowPolicy names the key file keys are escrowed to.
+type OrgEscrowPolicy struct {
+	PublicKey []byte    // X25519
+	Since     time.Time // when the policy was set
+}
+
+// Fingerprint identifies the policy's key; see Fingerprint.
+func (p *OrgEscrowPolicy) Fingerprint() string {
+	return Fingerprint(p.PublicKey)
+}
+
+// escrowedKey is what an escrow box holds.
+type escrowedKey struct {
+	Key   []byte
+	Owner string // user who created or last rotated the key
+	Name  string // their name for the file at the time
+}
+
+// EscrowedFile describes a file the escrow key can open.
+type EscrowedFile struct {
+	Root  uuid.UUID
+	Owner string
+	Name  string
+	Size  int64
+}
+
+// GenerateOrgEscrowKey returns a new X25519 key pair for SetOrgEscrow.
+// The private key should be kept offline.
+func GenerateOrgEscrowKey() (priv, pub []byte, err error) {
+	kp, err := newKeyPair(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return kp.Bytes(), kp.PublicKey().Bytes(), nil
+}
+
+// SetOrgEscrow makes pub the escrow key for every file key created from
+// now on, replacing any earlier policy.
+func (s *Store) SetOrgEscrow(pub []byte) error {
+	if _, err := ecdh.X25519().NewPublicKey(pub); err != nil {
+		return err
+	}
+	return s.withWrite(func() error {
+		s.OrgEscrow = &OrgEscrowPolicy{PublicKey: copyBytes(pub), Since: s.now()}
+		return nil
+	})
+}
+
+// ClearOrgEscrow stops escrowing new file keys.
+func (s *Store) ClearOrgEscrow() error {
+	return s.withWrite(func() error {
+		s.OrgEscrow = nil
+		return nil
+	})
+}
+
+// escrowFileKey seals rec's key for the file at root to the org escrow
+// key, or clears rec.Escrow when there is no policy.
+func (s *Store) escrowFileKey(root uuid.UUID, rec *fileRecord, owner, name string) error {
+	if s.OrgEscrow == nil {
+		rec.Escrow = nil
+		return nil
+	}
+	payload, err := json.Marshal(&escrowedKey{Key: rec.Key, Owner: owner, Name: name})
+	if err != nil {
+		return err
+	}
+	box, err := s.sealTo(s.OrgEscrow.PublicKey, payload, orgEscrowAD(root))
+	if err != nil {
+		return err
+	}
+	rec.Escrow = box
+	return nil
+}
+
+// OrgEscrowFiles lists the files whose keys priv can open, by root.
+func OrgEscrowFiles(s *Store, priv []byte) ([]EscrowedFile, error) {
+	kp, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	var out []EscrowedFile
+	for _, root := range sortedKeys(s.Files) {
+		ek, err := openEscrow(kp, root, s.Files[root])
+		if err != nil {
+			continue // not escrowed, or to another key
+		}
+		out = append(out, EscrowedFile{Root: root, Owner: ek.Owner, Name: ek.Name, Size: s.Files[root].Size})
+	}
+	return out, nil
+}
+
+// OrgEscrowDecrypt returns the current content of the file at root using
+// only the escrow private key priv.
+func OrgEscrowDecrypt(s *Store, priv []byte, root uuid.UUID) ([]byte, error) {
+	kp, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := s.Files[root]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ek, err := openEscrow(kp, root, rec)
+	if err != nil {
+		return nil, err
+	}
+	return s.readChunks(&fileRecord{Key: ek.Key, Chunks: rec.Chunks}, 0, len(rec.Chunks))
+}
+
+func openEscrow(kp *ecdh.PrivateKey, root uuid.UUID, rec *fileRecord) (*escrowedKey, error) {
+	if rec.Escrow == nil {
+		return nil, ErrNotEscrowed
+	}
+	payload, err := openFrom(kp, rec.Escrow, orgEscrowAD(root))
+	if err != nil {
+		return nil, ErrNotEscrowed
+	}
+	var ek escrowedKey
+	if err := json.Unmarshal(payload, &ek); err != nil {
+		return nil, err
+	}
+	return &ek, nil
+}
+
+// orgEscrowAD binds an escrowed key to its file.
+func orgEscrowAD(root uuid.UUID) []byte {
+	return append([]byte("securefs org escrow|"), root[:]...)
+}
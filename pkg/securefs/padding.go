@@ -0,0 +1,188 @@
+package securefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// PadMode selects how chunk envelopes are padded before sealing.
+type PadMode int
+
+const (
+	PadNone    PadMode = iota // exact length
+	PadPow2                   // next power of two
+	PadBuckets                // smallest of PaddingPolicy.Buckets that fits
+	PadFixed                  // every chunk as large as a full one
+)
+
+func (m PadMode) String() string {
+	switch m {
+	case PadNone:
+		return "none"
+	case PadPow2:
+		return "pow2"
+	case PadBuckets:
+		return "buckets"
+	case PadFixed:
+		return "fixed"
+	}
+	return fmt.Sprintf("PadMode(%d)", int(m))
+}
+
+// ParsePadMode is the inverse of PadMode.String.
+func ParsePadMode(s string) (PadMode, error) {
+	for _, m := range []PadMode{PadNone, PadPow2, PadBuckets, PadFixed} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown padding mode %q", s)
+}
+
+// PaddingPolicy hides how long each chunk's plaintext is from its
+// ciphertext. Padding sits inside the AEAD, so it is authenticated and the
+// ciphertext shows only the padded size. It does not hide lengths from
+// anyone who can read the store: the file record keeps every chunk's
+// plaintext offset and the file's size in the clear, for random access
+// and for checks without credentials. Padding only helps against an
+// observer who sees chunk ciphertexts alone.
+type PaddingPolicy struct {
+	Mode    PadMode
+	Buckets []int `json:",omitempty"` // ascending envelope sizes for PadBuckets
+}
+
+// A padded envelope sets padFlag on the codec byte and records the true
+// payload length:
+//
+//	codec|padFlag (1) | payload length (4, big-endian) | payload | zeros
+const (
+	padFlag   = 0x80
+	padHeader = 1 + 4
+)
+
+var errBadPadding = errors.New("invalid padding policy")
+
+func (p *PaddingPolicy) validate() error {
+	switch p.Mode {
+	case PadNone, PadPow2, PadFixed:
+		return nil
+	case PadBuckets:
+		if len(p.Buckets) == 0 || !sort.IntsAreSorted(p.Buckets) || p.Buckets[0] <= padHeader {
+			return errBadPadding
+		}
+		return nil
+	}
+	return errBadPadding
+}
+
+// target returns the padded envelope size for an envelope of n bytes.
+func (p *PaddingPolicy) target(n int) int {
+	switch p.Mode {
+	case PadPow2:
+		t := 1
+		for t < n {
+			t <<= 1
+		}
+		return t
+	case PadBuckets:
+		for _, b := range p.Buckets {
+			if n <= b {
+				return b
+			}
+		}
+		// past the largest bucket: round up to a multiple of it
+		last := p.Buckets[len(p.Buckets)-1]
+		return (n + last - 1) / last * last
+	case PadFixed:
+		if full := padHeader + chunkSize; n < full {
+			return full
+		}
+	}
+	return n
+}
+
+// pad wraps an unpadded envelope (codec byte, payload) per p.
+func (p *PaddingPolicy) pad(env []byte) []byte {
+	if p == nil || p.Mode == PadNone {
+		return env
+	}
+	payload := env[1:]
+	out := make([]byte, p.target(padHeader+len(payload)))
+	out[0] = env[0] | padFlag
+	binary.BigEndian.PutUint32(out[1:padHeader], uint32(len(payload)))
+	copy(out[padHeader:], payload)
+	return out
+}
+
+// unpad strips padding from an opened envelope, returning codec byte and
+// payload in the unpadded layout.
+func unpad(env []byte) ([]byte, error) {
+	if len(env) == 0 || env[0]&padFlag == 0 {
+		return env, nil
+	}
+	if len(env) < padHeader {
+		return nil, errBadEnvelope
+	}
+	n := binary.BigEndian.Uint32(env[1:padHeader])
+	if uint64(n) > uint64(len(env)-padHeader) {
+		return nil, errBadEnvelope
+	}
+	out := make([]byte, 1+n)
+	out[0] = env[0] &^ padFlag
+	copy(out[1:], env[padHeader:padHeader+int(n)])
+	return out, nil
+}
+
+// SetPadding sets the padding policy for the named file's future writes.
+// Existing chunks keep the padding they were written with.
+func (c *Client) SetPadding(name string, policy PaddingPolicy) error {
+	if err := policy.validate(); err != nil { return err }
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if policy.Mode == PadNone {
+		rec.Padding = nil
+	} else {
+		rec.Padding = &policy
+	}
+	return c.persist()
+}
+
+// FileInfo describes a file as Stat sees it.
+type FileInfo struct {
+	Name        string
+	Size        int64 // true plaintext size, without padding
+	Stored      int64 // ciphertext bytes of the current chunks
+	Chunks      int
+	Compression Codec
+	Padding     PaddingPolicy
+	Dedup       bool
+	History     bool
+	Escrowed    bool // the key is sealed to the org escrow key; see Store.OrgEscrow
+}
+
+// Stat describes the named file without reading its content.
+func (c *Client) Stat(name string) (FileInfo, error) {
+	rec, err := c.record(name)
+	if err != nil { return FileInfo{}, err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return FileInfo{}, err }
+	}
+	fi := FileInfo{
+		Name:        name,
+		Size:        rec.Size,
+		Chunks:      len(rec.Chunks),
+		Compression: rec.Compression,
+		Dedup:       rec.Dedup,
+		History:     rec.History != nil,
+		Escrowed:    rec.Escrow != nil,
+	}
+	if rec.Padding != nil {
+		fi.Padding = *rec.Padding
+	}
+	for _, id := range rec.Chunks {
+		fi.Stored += int64(len(c.store.Chunks[id]))
+	}
+	return fi, nil
+}
@@ -0,0 +1,111 @@
+package securefs
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// Users hold an X25519 key pair so others can encrypt to them without a
+// shared secret: the public key sits in the user record, the private key
+// in the sealed userPrivate. Sealing to a public key P works like ECIES:
+//
+//	e  = fresh X25519 key pair
+//	K  = HKDF(X25519(e, P), e.pub || P, "securefs v1 sealed box key")
+//	out = e.pub (32) || seal(K, plaintext, ad)
+//
+// so only the holder of P's private key can derive K, and each sealed box
+// uses a key of its own.
+const labelSealedBox = "securefs v1 sealed box key"
+
+// labelHeadSigning derives a user's Ed25519 key for signing epoch heads
+// from their X25519 private key, so it needs no storage of its own; the
+// public half is userRecord.SignKey.
+const labelHeadSigning = "securefs v1 head signing key"
+
+var errSealedBox = errors.New("sealed box too short")
+
+// newKeyPair returns a fresh X25519 key pair drawn from rnd. It reads the
+// scalar itself rather than calling GenerateKey, which may consume a
+// variable number of bytes and so defeat WithRand.
+func newKeyPair(rnd io.Reader) (*ecdh.PrivateKey, error) {
+	b, err := randomBytes(rnd, 32)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// sealTo encrypts plaintext so only the holder of pub's private key can
+// open it.
+func (s *Store) sealTo(pub []byte, plaintext, ad []byte) ([]byte, error) {
+	to, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := newKeyPair(s.random())
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealedBoxKey(eph, to, eph.PublicKey().Bytes(), pub)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := seal(s.random(), s.suite(), key, plaintext, ad)
+	if err != nil {
+		return nil, err
+	}
+	return append(eph.PublicKey().Bytes(), ct...), nil
+}
+
+// openFrom opens a box sealed to priv's public key.
+func openFrom(priv *ecdh.PrivateKey, box, ad []byte) ([]byte, error) {
+	if len(box) < 32 {
+		return nil, errSealedBox
+	}
+	eph, err := ecdh.X25519().NewPublicKey(box[:32])
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealedBoxKey(priv, eph, box[:32], priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return symDecAD(key, box[32:], ad)
+}
+
+// sealedBoxKey derives the key of the box from ephemeral to recipient,
+// where priv and peer are one of the two key pairs' private key and the
+// other's public key.
+func sealedBoxKey(priv *ecdh.PrivateKey, peer *ecdh.PublicKey, ephemeral, recipient []byte) ([]byte, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return hkdfKey(shared, salt, labelSealedBox, keySize)
+}
+
+// Fingerprint is a short, human-comparable digest of a public key.
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return groupCode(hex.EncodeToString(sum[:8]))
+}
+
+// privateKey returns the caller's X25519 private key.
+func (c *Client) privateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(c.priv.PrivateKey)
+}
+
+// signingKey derives the Ed25519 key a user signs epoch heads with from
+// their X25519 private key.
+func signingKey(priv []byte) (ed25519.PrivateKey, error) {
+	seed, err := hkdfKey(priv, nil, labelHeadSigning, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
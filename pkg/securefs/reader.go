@@ -0,0 +1,128 @@
+package securefs
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrStale is returned by a FileReader whose file was rewritten since it
+// was opened.
+var ErrStale = errors.New("file changed since it was opened")
+
+// FileReader gives random access to a file's plaintext. Each read decrypts
+// only the chunks overlapping the requested range; the most recently used
+// chunk is cached so sequential reads don't decrypt it twice.
+//
+// A FileReader reads the chunks the file had when it was opened. Writes
+// through any client (StoreFile, WriteAt, Truncate, Revoke) release the
+// chunks they replace unless retained history or a snapshot still pins
+// them; a later read that needs a released chunk fails with ErrStale.
+// Open the file again to read its new content.
+type FileReader struct {
+	store   *Store
+	key     []byte
+	chunks  []uuid.UUID
+	offsets []int64
+	size    int64
+
+	pos int64 // for Read and Seek
+
+	mu  sync.Mutex
+	cur int // index of cached chunk, -1 if none
+	buf []byte
+}
+
+// Open returns a reader over the named file implementing io.ReaderAt and
+// io.Seeker.
+func (c *Client) Open(name string) (*FileReader, error) {
+	rec, err := c.record(name)
+	if err != nil { return nil, err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return nil, err }
+	}
+	return &FileReader{
+		store:   c.store,
+		key:     copyBytes(rec.Key),
+		chunks:  append([]uuid.UUID(nil), rec.Chunks...),
+		offsets: append([]int64(nil), rec.Offsets...),
+		size:    rec.Size,
+		cur:     -1,
+	}, nil
+}
+
+// Size returns the plaintext length of the file.
+func (r *FileReader) Size() int64 { return r.size }
+
+// chunk returns the plaintext of chunk i, decrypting it if not cached.
+func (r *FileReader) chunk(i int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == i {
+		return r.buf, nil
+	}
+	ct, ok := r.store.Chunks[r.chunks[i]]
+	if !ok {
+		return nil, ErrStale
+	}
+	pt, err := r.store.openChunk(r.key, ct)
+	if err != nil {
+		return nil, err
+	}
+	r.cur, r.buf = i, pt
+	return pt, nil
+}
+
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		i := chunkAt(r.offsets, off)
+		pt, err := r.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], pt[off-r.offsets[i]:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = abs
+	return abs, nil
+}
@@ -0,0 +1,112 @@
+package securefs
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// ErrBadRecoveryCode is returned by Recover for a code that is wrong,
+// already used, or replaced by a newer batch.
+var ErrBadRecoveryCode = errors.New("invalid or used recovery code")
+
+const (
+	recoveryCodeCount = 10 // codes per batch
+	recoveryCodeBytes = 10 // 80 bits each
+)
+
+// recoveryCode is one unused code: the user keys sealed under a key
+// derived from the code.
+type recoveryCode struct {
+	Salt    []byte
+	Wrapped []byte
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes returns a fresh batch of one-time codes, each of
+// which can reset the caller's password through Recover. Codes from any
+// earlier batch stop working. Only the returned strings can recover the
+// account, so they must be written down now; the store keeps just the
+// keys they unwrap.
+func (c *Client) GenerateRecoveryCodes() ([]string, error) {
+	rec := c.store.Users[c.username]
+	keys := userKeys{state: c.masterKey, holder: c.holderKey}
+	codes := make([]string, recoveryCodeCount)
+	entries := make([]*recoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw, err := randomBytes(c.store.random(), recoveryCodeBytes)
+		if err != nil { return nil, err }
+		code := recoveryEncoding.EncodeToString(raw)
+		salt, err := randomBytes(c.store.random(), 16)
+		if err != nil { return nil, err }
+		k, err := hkdfKey([]byte(code), salt, labelRecoveryCode, keySize)
+		if err != nil { return nil, err }
+		wrapped, err := seal(c.store.random(), c.store.suite(), k, keys.marshal(), recoveryAD(c.username))
+		if err != nil { return nil, err }
+		codes[i] = groupCode(code)
+		entries[i] = &recoveryCode{Salt: salt, Wrapped: wrapped}
+	}
+	rec.Recovery = entries
+	return codes, c.persist()
+}
+
+// RecoveryCodesLeft reports how many of the caller's recovery codes are
+// unused.
+func (c *Client) RecoveryCodesLeft() int {
+	return len(c.store.Users[c.username].Recovery)
+}
+
+// Recover sets a new password for username with one of their recovery
+// codes and logs in. The code is consumed; the others stay valid. Files,
+// shares and history are untouched, since only the wrapping of the user's
+// keys changes.
+func Recover(store *Store, username, code, newPassword string) (*Client, error) {
+	if newPassword == "" {
+		return nil, errors.New("empty credentials")
+	}
+	rec, ok := store.Users[username]
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	norm := normalizeCode(code)
+	for i, rc := range rec.Recovery {
+		k, err := hkdfKey([]byte(norm), rc.Salt, labelRecoveryCode, keySize)
+		if err != nil { return nil, err }
+		// a wrong code fails the key commitment, before any decryption
+		b, err := symDecAD(k, rc.Wrapped, recoveryAD(username))
+		if err != nil { continue }
+		keys, err := parseUserKeys(b)
+		if err != nil { return nil, err }
+		err = store.withWrite(func() error {
+			if err := store.wrapUserKeys(rec, newPassword, keys); err != nil { return err }
+			rec.Recovery = append(rec.Recovery[:i:i], rec.Recovery[i+1:]...)
+			return nil
+		})
+		if err != nil { return nil, err }
+		return Login(store, username, newPassword)
+	}
+	return nil, ErrBadRecoveryCode
+}
+
+// recoveryAD binds a recovery code's wrapped keys to their user.
+func recoveryAD(username string) []byte {
+	return []byte("securefs recovery code|" + username)
+}
+
+// groupCode splits a code into dash-separated groups of four for reading
+// aloud and writing down.
+func groupCode(code string) string {
+	var parts []string
+	for len(code) > 4 {
+		parts = append(parts, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(parts, code), "-")
+}
+
+// normalizeCode undoes groupCode and forgives case and stray spaces.
+func normalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
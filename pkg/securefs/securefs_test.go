@@ -1,10 +1,29 @@
 package securefs
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // ---- helpers ----
@@ -20,6 +39,15 @@ func newTempStore(t *testing.T) *Store {
 	return s
 }
 
+// legacyEnc seals the way builds before ciphertext headers did:
+// AES-GCM, nonce first, no associated data.
+func legacyEnc(key, pt []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := must(RandomBytes(12))
+	return aead.Seal(nonce, nonce, pt, nil)
+}
+
 func mustLogin(t *testing.T, s *Store, user, pass string) *Client {
 	t.Helper()
 	c, err := Login(s, user, pass)
@@ -290,6 +318,49 @@ func TestRevoke_KeyRotationAndNewShare(t *testing.T) {
 	}
 }
 
+func TestRevoke_StaleShareCodeIsRejected(t *testing.T) {
+	s := newTempStore(t)
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	if err := alice.StoreFile("doc", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mustLogin(t, s, "bob", "pw").AcceptShare("doc", code); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Revoke("doc"); err != nil {
+		t.Fatal(err)
+	}
+	rec := s.Files[alice.priv.FileIndex["doc"]]
+	key := append([]byte{}, rec.Key...)
+
+	// Anyone holding the old code, including a revoked recipient, is
+	// turned away and the record keeps its current key.
+	for _, u := range []string{"bob", "carol"} {
+		c := mustLogin(t, s, u, "pw")
+		if err := c.AcceptShare("again", code); !errors.Is(err, ErrStaleShare) {
+			t.Fatalf("%s: stale code accepted: %v", u, err)
+		}
+		if _, ok := c.priv.FileIndex["again"]; ok {
+			t.Fatalf("%s: stale code bound a name", u)
+		}
+	}
+	if !bytes.Equal(rec.Key, key) {
+		t.Fatal("stale code changed the file key")
+	}
+	if got, err := alice.LoadFile("doc"); err != nil || string(got) != "alpha" {
+		t.Fatalf("owner lost access after a stale code: %q %v", got, err)
+	}
+}
+
 // ==========================
 // Integrity: tamper chunks
 // ==========================
@@ -362,3 +433,4003 @@ func TestPersistence_SaveAndReopen(t *testing.T) {
 		t.Fatalf("persistence lost, got %q", string(got))
 	}
 }
+
+// ==========================
+// Random access
+// ==========================
+
+func TestOpen_ReadAtAndSeekAcrossChunks(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	data := make([]byte, 3*chunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := alice.StoreFile("big.bin", data[:2*chunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("big.bin", data[2*chunkSize:]); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := alice.Open("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("size mismatch: want %d, got %d", len(data), r.Size())
+	}
+
+	// Range spanning a chunk boundary.
+	buf := make([]byte, 200)
+	off := int64(chunkSize - 100)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[off:off+200]) {
+		t.Fatalf("ReadAt across boundary returned wrong bytes")
+	}
+
+	// Short read at the tail reports io.EOF.
+	n, err := r.ReadAt(buf, int64(len(data)-50))
+	if n != 50 || err != io.EOF {
+		t.Fatalf("tail ReadAt: want 50, io.EOF; got %d, %v", n, err)
+	}
+
+	// Seek then read to the end.
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, data[len(data)-10:]) {
+		t.Fatalf("read after Seek returned wrong bytes")
+	}
+}
+
+func TestOpen_DecryptsOnlyOverlappingChunks(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	data := bytes.Repeat([]byte("x"), 2*chunkSize+10)
+	if err := alice.StoreFile("f.bin", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the first chunk; a read confined to the last one still works.
+	rec := s.Files[alice.priv.FileIndex["f.bin"]]
+	s.Chunks[rec.Chunks[0]][20] ^= 0xFF
+
+	r, err := alice.Open("f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := r.ReadAt(buf, 2*chunkSize); err != nil {
+		t.Fatalf("read of intact chunk failed: %v", err)
+	}
+	if _, err := r.ReadAt(buf, 0); err == nil {
+		t.Fatalf("expected read of corrupted chunk to fail, got nil")
+	}
+}
+
+func TestOpen_LegacyRecordWithoutOffsets(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("old.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("old.txt", []byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a record written before offsets were tracked.
+	rec := s.Files[alice.priv.FileIndex["old.txt"]]
+	rec.Offsets, rec.Size = nil, 0
+
+	r, err := alice.Open("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := r.ReadAt(buf, 6); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world" {
+		t.Fatalf("want %q, got %q", "world", string(buf))
+	}
+}
+
+func TestOpen_RewriteMakesReaderStale(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	old := bytes.Repeat([]byte("a"), 2*chunkSize)
+	if err := alice.StoreFile("f.bin", old); err != nil {
+		t.Fatal(err)
+	}
+	r, err := alice.Open("f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("f.bin", bytes.Repeat([]byte("b"), 2*chunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	// The cached chunk still reads; the released one does not.
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		t.Fatalf("cached chunk: %v", err)
+	}
+	if _, err := r.ReadAt(buf, chunkSize); !errors.Is(err, ErrStale) {
+		t.Fatalf("want ErrStale after rewrite, got %v", err)
+	}
+
+	// Retained history keeps the old chunks, so the reader carries on.
+	if err := alice.EnableHistory("f.bin", RetentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = alice.Open("f.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.WriteAt("f.bin", chunkSize, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(buf, chunkSize); err != nil || buf[0] != 'b' {
+		t.Fatalf("pinned chunk: %q %v", buf, err)
+	}
+}
+
+// ==========================
+// In-place writes & truncate
+// ==========================
+
+func TestWriteAt_OverwritesRangeAndKeepsShares(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "bob", "builder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	bob := mustLogin(t, s, "bob", "builder")
+
+	data := bytes.Repeat([]byte("a"), 3*chunkSize)
+	if err := alice.StoreFile("db.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("db.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.AcceptShare("db.bin", code); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := s.Files[alice.priv.FileIndex["db.bin"]]
+	before := append([]uuid.UUID(nil), rec.Chunks...)
+
+	// Bob overwrites a range straddling the first chunk boundary.
+	patch := bytes.Repeat([]byte("b"), 20)
+	off := int64(chunkSize - 10)
+	if err := bob.WriteAt("db.bin", off, patch); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[off:], patch)
+
+	got, err := alice.LoadFile("db.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("owner sees wrong content after collaborator WriteAt")
+	}
+	if rec.Chunks[2] != before[2] {
+		t.Fatalf("untouched chunk was rewritten")
+	}
+	if rec.Chunks[0] == before[0] || rec.Chunks[1] == before[1] {
+		t.Fatalf("overlapping chunks were not re-sealed")
+	}
+	if _, ok := s.Chunks[before[0]]; ok {
+		t.Fatalf("replaced chunk left behind in store")
+	}
+
+	// Writing past the end zero-fills the gap.
+	if err := alice.WriteAt("db.bin", int64(len(data))+5, []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, 0, 0, 0, 0, 0, 'z')
+	got, err = bob.LoadFile("db.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("WriteAt past end produced wrong content")
+	}
+}
+
+func TestTruncate_ShrinkAndGrow(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	data := make([]byte, 2*chunkSize+500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := alice.StoreFile("log.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	rec := s.Files[alice.priv.FileIndex["log.bin"]]
+	first := rec.Chunks[0]
+
+	if err := alice.Truncate("log.bin", chunkSize+7); err != nil {
+		t.Fatal(err)
+	}
+	got, err := alice.LoadFile("log.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[:chunkSize+7]) {
+		t.Fatalf("shrink produced wrong content")
+	}
+	if len(rec.Chunks) != 2 || rec.Chunks[0] != first {
+		t.Fatalf("shrink should keep the first chunk and re-seal the second, got %d chunks", len(rec.Chunks))
+	}
+	if len(s.Chunks) != 2 {
+		t.Fatalf("dropped chunks left behind: %d in store", len(s.Chunks))
+	}
+
+	if err := alice.Truncate("log.bin", chunkSize+10); err != nil {
+		t.Fatal(err)
+	}
+	got, err = alice.LoadFile("log.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, data[:chunkSize+7]...), 0, 0, 0)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("grow should zero-fill")
+	}
+
+	if err := alice.Truncate("log.bin", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := alice.LoadFile("log.bin"); len(got) != 0 {
+		t.Fatalf("expected empty file, got %d bytes", len(got))
+	}
+}
+
+// ==========================
+// Overwrite semantics
+// ==========================
+
+func TestStoreFile_OverwriteAfterSharePreservesShare(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "bob", "builder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	bob := mustLogin(t, s, "bob", "builder")
+
+	if err := alice.StoreFile("plan.txt", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("plan.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.AcceptShare("plan_copy.txt", code); err != nil {
+		t.Fatal(err)
+	}
+	root := alice.priv.FileIndex["plan.txt"]
+
+	// Owner overwrites: collaborator sees the new content.
+	if err := alice.StoreFile("plan.txt", []byte("v2 from alice")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bob.LoadFile("plan_copy.txt"); err != nil || string(got) != "v2 from alice" {
+		t.Fatalf("collaborator view after owner overwrite: %q, %v", string(got), err)
+	}
+
+	// Collaborator overwrites: owner sees the new content.
+	if err := bob.StoreFile("plan_copy.txt", []byte("v3 from bob")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := alice.LoadFile("plan.txt"); err != nil || string(got) != "v3 from bob" {
+		t.Fatalf("owner view after collaborator overwrite: %q, %v", string(got), err)
+	}
+
+	if alice.priv.FileIndex["plan.txt"] != root || bob.priv.FileIndex["plan_copy.txt"] != root {
+		t.Fatalf("overwrite rebound the file to a new root")
+	}
+	if len(s.Files) != 1 {
+		t.Fatalf("expected a single file record, got %d", len(s.Files))
+	}
+	if len(s.Chunks) != len(s.Files[root].Chunks) {
+		t.Fatalf("orphaned chunks left behind: %d in store, %d referenced", len(s.Chunks), len(s.Files[root].Chunks))
+	}
+}
+
+// ==========================
+// Version history
+// ==========================
+
+func TestHistory_ListLoadRestore(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("doc.txt", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableHistory("doc.txt", RetentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("doc.txt", []byte(" two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("doc.txt", []byte("oops")); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := alice.ListVersions("doc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || vs[0].Version != 1 || vs[1].Version != 2 {
+		t.Fatalf("unexpected versions: %+v", vs)
+	}
+	for v, want := range map[int]string{1: "one", 2: "one two"} {
+		got, err := alice.LoadVersion("doc.txt", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("version %d: want %q, got %q", v, want, string(got))
+		}
+	}
+	if _, err := alice.LoadVersion("doc.txt", 99); err != ErrNoVersion {
+		t.Fatalf("expected ErrNoVersion, got %v", err)
+	}
+
+	if err := alice.RestoreVersion("doc.txt", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := alice.LoadFile("doc.txt"); string(got) != "one two" {
+		t.Fatalf("restore produced %q", string(got))
+	}
+	// The replaced state is kept so the restore can be undone.
+	if got, _ := alice.LoadVersion("doc.txt", 3); string(got) != "oops" {
+		t.Fatalf("pre-restore state not recorded, got %q", string(got))
+	}
+}
+
+func TestHistory_RetentionPrunesVersionsAndChunks(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("log.txt", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableHistory("log.txt", RetentionPolicy{KeepVersions: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1", "2", "3", "4"} {
+		if err := alice.StoreFile("log.txt", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vs, _ := alice.ListVersions("log.txt")
+	if len(vs) != 2 || vs[0].Version != 3 || vs[1].Version != 4 {
+		t.Fatalf("keep-2 policy left %+v", vs)
+	}
+	rec := s.Files[alice.priv.FileIndex["log.txt"]]
+	if len(s.Chunks) != len(rec.liveChunks()) {
+		t.Fatalf("pruned chunks left behind: %d in store, %d live", len(s.Chunks), len(rec.liveChunks()))
+	}
+
+	// Age-based retention, applied by an explicit prune.
+	if err := alice.EnableHistory("log.txt", RetentionPolicy{KeepFor: 24 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	rec.History.Versions[0].Time = time.Now().Add(-48 * time.Hour)
+	n, err := alice.PruneVersions("log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 expired version, dropped %d", n)
+	}
+	if got, _ := alice.LoadFile("log.txt"); string(got) != "4" {
+		t.Fatalf("prune touched current content: %q", string(got))
+	}
+}
+
+func TestHistory_SurvivesRevoke(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("s.txt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableHistory("s.txt", RetentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("s.txt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Revoke("s.txt"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := alice.LoadVersion("s.txt", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old" {
+		t.Fatalf("version after revoke: %q", string(got))
+	}
+}
+
+// ==========================
+// Snapshots
+// ==========================
+
+func TestSnapshot_RestoreAfterDeleteAndBadAppend(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("a.txt", []byte("alpha")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("b.txt", []byte("beta")); err != nil {
+		t.Fatal(err)
+	}
+	chunksBefore := len(s.Chunks)
+	if err := alice.Snapshot("daily"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Chunks) != chunksBefore {
+		t.Fatalf("snapshot copied chunk data: %d -> %d", chunksBefore, len(s.Chunks))
+	}
+	if err := alice.Snapshot("daily"); err == nil {
+		t.Fatalf("expected duplicate label to fail, got nil")
+	}
+
+	// Damage: delete one file, clobber and append to the other.
+	if err := alice.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("b.txt", []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("b.txt", []byte("more garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.LoadFile("a.txt"); err != ErrNotFound {
+		t.Fatalf("expected deleted file to be gone, got %v", err)
+	}
+
+	names, err := alice.SnapshotFiles("daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a.txt" || names[1] != "b.txt" {
+		t.Fatalf("unexpected snapshot listing: %v", names)
+	}
+	if got, err := alice.LoadSnapshotFile("daily", "b.txt"); err != nil || string(got) != "beta" {
+		t.Fatalf("browse snapshot: %q, %v", string(got), err)
+	}
+
+	if err := alice.RestoreSnapshot("daily"); err != nil {
+		t.Fatal(err)
+	}
+	// A fresh session sees the restored namespace.
+	alice = mustLogin(t, s, "alice", "wonder")
+	for name, want := range map[string]string{"a.txt": "alpha", "b.txt": "beta"} {
+		got, err := alice.LoadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s after restore: want %q, got %q", name, want, string(got))
+		}
+	}
+}
+
+func TestSnapshot_PinsChunksUntilDeleted(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("f.txt", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Snapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Files[alice.priv.FileIndex["f.txt"]].Chunks[0]
+	if err := alice.StoreFile("f.txt", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Chunks[old]; !ok {
+		t.Fatalf("overwrite released a chunk the snapshot pins")
+	}
+
+	// Revoke re-encrypts pinned chunks too; the snapshot stays readable.
+	if err := alice.Revoke("f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := alice.LoadSnapshotFile("s1", "f.txt"); err != nil || string(got) != "v1" {
+		t.Fatalf("snapshot after revoke: %q, %v", string(got), err)
+	}
+
+	if err := alice.DeleteSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Files[alice.priv.FileIndex["f.txt"]].Chunks); len(s.Chunks) != n {
+		t.Fatalf("deleting snapshot left %d chunks, want %d", len(s.Chunks), n)
+	}
+	if len(alice.ListSnapshots()) != 0 {
+		t.Fatalf("snapshot still listed after delete")
+	}
+}
+
+// ==========================
+// Garbage collection
+// ==========================
+
+func TestGC_DryRunThenSweep(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "bob", "builder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	bob := mustLogin(t, s, "bob", "builder")
+
+	if err := alice.StoreFile("private.txt", []byte("only mine")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("shared.txt", []byte("ours")); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("shared.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.AcceptShare("shared.txt", code); err != nil {
+		t.Fatal(err)
+	}
+	privateRoot := alice.priv.FileIndex["private.txt"]
+	privateChunk := s.Files[privateRoot].Chunks[0]
+
+	if err := alice.Delete("private.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete("shared.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a half-finished Revoke leaving a chunk nobody refers to.
+	stray := uuid.New()
+	s.Chunks[stray] = []byte("0123456789")
+
+	rep := s.GCDryRun()
+	if !rep.DryRun || rep.Files != 1 || rep.Chunks != 2 {
+		t.Fatalf("unexpected dry-run report: %+v", rep)
+	}
+	want := int64(len(s.Chunks[stray]) + len(s.Chunks[privateChunk]))
+	if rep.Bytes != want {
+		t.Fatalf("reclaimable bytes: want %d, got %d", want, rep.Bytes)
+	}
+	if _, ok := s.Files[privateRoot]; !ok {
+		t.Fatalf("dry run removed a record")
+	}
+
+	rep, err = s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.DryRun || rep.Files != 1 || rep.Chunks != 2 {
+		t.Fatalf("unexpected GC report: %+v", rep)
+	}
+	if _, ok := s.Files[privateRoot]; ok {
+		t.Fatalf("unreachable record survived GC")
+	}
+	if _, ok := s.Chunks[stray]; ok {
+		t.Fatalf("stray chunk survived GC")
+	}
+	// Bob still holds the shared file.
+	if got, err := bob.LoadFile("shared.txt"); err != nil || string(got) != "ours" {
+		t.Fatalf("GC broke a collaborator's file: %q, %v", string(got), err)
+	}
+	if rep := s.GCDryRun(); rep.Files != 0 || rep.Chunks != 0 {
+		t.Fatalf("second pass found more garbage: %+v", rep)
+	}
+}
+
+func TestGC_KeepsSnapshotsAndUntrackedRecords(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	if err := alice.StoreFile("keep.txt", []byte("snap me")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("legacy.txt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete("keep.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// A record written before holders were tracked.
+	legacy := s.Files[alice.priv.FileIndex["legacy.txt"]]
+	legacy.Holders = nil
+
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.RestoreSnapshotFile("s", "keep.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := alice.LoadFile("keep.txt"); err != nil || string(got) != "snap me" {
+		t.Fatalf("restore after GC: %q, %v", string(got), err)
+	}
+	if got, err := alice.LoadFile("legacy.txt"); err != nil || string(got) != "old" {
+		t.Fatalf("GC swept an untracked record: %q, %v", string(got), err)
+	}
+
+	// Logging in registers holders for entries made before tracking.
+	mustLogin(t, s, "alice", "wonder")
+	if len(legacy.Holders) != 1 {
+		t.Fatalf("login did not register legacy holder, got %d", len(legacy.Holders))
+	}
+}
+
+func TestGC_KeepsLegacyRecordsUntilEveryUserRegisters(t *testing.T) {
+	s := newTempStore(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	bob := mustLogin(t, s, "bob", "pw")
+	if err := alice.StoreFile("doc", []byte("both of us")); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.AcceptShare("doc", code); err != nil {
+		t.Fatal(err)
+	}
+	// Rewind to before holders were tracked.
+	root := alice.priv.FileIndex["doc"]
+	s.Files[root].Holders = nil
+	for _, u := range s.Users {
+		u.Tracked = false
+	}
+
+	// Bob registers and deletes his entry; Alice has not logged in since.
+	bob = mustLogin(t, s, "bob", "pw")
+	if err := bob.Delete("doc"); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err := s.GC(); err != nil || rep.Files != 0 {
+		t.Fatalf("GC collected a record an untracked user holds: %+v, %v", rep, err)
+	}
+	if r := s.Check(); len(r.Problems) != 0 {
+		t.Fatalf("record reported unreachable: %+v", r.Problems)
+	}
+	if got, err := alice.LoadFile("doc"); err != nil || string(got) != "both of us" {
+		t.Fatalf("legacy holder lost the file: %q, %v", got, err)
+	}
+
+	// Once Alice registers, her tag keeps it; once she deletes, it goes.
+	alice = mustLogin(t, s, "alice", "pw")
+	if rep, _ := s.GC(); rep.Files != 0 {
+		t.Fatalf("GC collected a held record: %+v", rep)
+	}
+	if err := alice.Delete("doc"); err != nil {
+		t.Fatal(err)
+	}
+	if rep, _ := s.GC(); rep.Files != 1 {
+		t.Fatalf("want the record collected, got %+v", rep)
+	}
+}
+
+func TestGC_MissingRecordIsNotFound(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("gone", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	delete(s.Files, alice.priv.FileIndex["gone"])
+
+	calls := map[string]func() error{
+		"LoadFile":    func() error { _, err := alice.LoadFile("gone"); return err },
+		"Open":        func() error { _, err := alice.Open("gone"); return err },
+		"AppendFile":  func() error { return alice.AppendFile("gone", []byte("y")) },
+		"WriteAt":     func() error { return alice.WriteAt("gone", 0, []byte("y")) },
+		"Truncate":    func() error { return alice.Truncate("gone", 0) },
+		"CreateShare": func() error { _, err := alice.CreateShare("gone"); return err },
+		"Revoke":      func() error { return alice.Revoke("gone") },
+		"Stat":        func() error { _, err := alice.Stat("gone"); return err },
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: want ErrNotFound, got %v", name, err)
+		}
+	}
+
+	// A damaged store can carry a null record; GC leaves it to Check.
+	if err := alice.StoreFile("nulled", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	root := alice.priv.FileIndex["nulled"]
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var files map[string]json.RawMessage
+	if err := json.Unmarshal(doc["Files"], &files); err != nil {
+		t.Fatal(err)
+	}
+	files[root.String()] = json.RawMessage("null")
+	doc["Files"], _ = json.Marshal(files)
+	b, _ = json.Marshal(doc)
+	if err := os.WriteFile(s.path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, ok := s.Files[root]; !ok || rec != nil {
+		t.Fatalf("record not null after reload: %v %v", rec, ok)
+	}
+	s.GCDryRun()
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if rep := s.Check(); !rep.Corrupt() {
+		t.Fatalf("null record not reported")
+	}
+}
+
+// ==========================
+// Compaction
+// ==========================
+
+func TestCompact_ShrinksAndRoundTrips(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+
+	// A store as ordinary saves leave it: dense JSON, chunks in base64.
+	data := make([]byte, 3*chunkSize)
+	if _, err := rand.New(rand.NewSource(1)).Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("keep.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("junk.bin", bytes.Repeat([]byte("j"), 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete("junk.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Encoding() != EncodingJSON {
+		t.Fatalf("store saved as %v", s.Encoding())
+	}
+
+	rep, err := s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base64 costs 4 bytes per 3; most of that comes back
+	if rep.After*5 > rep.Before*4 {
+		t.Fatalf("compacted %d -> %d bytes, want at least a fifth off", rep.Before, rep.After)
+	}
+	if s.Encoding() != EncodingBinary {
+		t.Fatalf("compacted store is %v", s.Encoding())
+	}
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != rep.After {
+		t.Fatalf("reported %d bytes, file has %d", rep.After, fi.Size())
+	}
+	if matches, _ := filepath.Glob(s.path + ".*"); len(matches) != 0 {
+		t.Fatalf("temp files left behind: %v", matches)
+	}
+
+	s2, err := OpenStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice2 := mustLogin(t, s2, "alice", "wonder")
+	if got, err := alice2.LoadFile("keep.bin"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("after compact: %d bytes, %v", len(got), err)
+	}
+	// Compacting again changes nothing.
+	if again, err := s2.Compact(); err != nil || again.After != again.Before {
+		t.Fatalf("second compact: %+v %v", again, err)
+	}
+}
+
+// ==========================
+// fsck
+// ==========================
+
+func TestCheck_CleanStoreHasNoProblems(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableHistory("a.txt", RetentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("a.txt", []byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+
+	rep := alice.Check()
+	if len(rep.Problems) != 0 {
+		t.Fatalf("unexpected problems: %+v", rep.Problems)
+	}
+	// current list, one version, one snapshot pin
+	if rep.Verified != 3 {
+		t.Fatalf("expected 3 verified chunk lists, got %d", rep.Verified)
+	}
+	if _, err := json.Marshal(rep); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck_SortedKeysOrder(t *testing.T) {
+	ids := map[uuid.UUID]bool{}
+	for i := 0; i < 50; i++ {
+		ids[uuid.New()] = true
+	}
+	got := sortedKeys(ids)
+	if len(got) != len(ids) {
+		t.Fatalf("got %d keys, want %d", len(got), len(ids))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1].String() >= got[i].String() {
+			t.Fatalf("keys out of order at %d: %s, %s", i, got[i-1], got[i])
+		}
+	}
+	names := sortedKeys(map[string]int{"carol": 1, "alice": 2, "bob": 3})
+	if strings.Join(names, ",") != "alice,bob,carol" {
+		t.Fatalf("names: %v", names)
+	}
+}
+
+func TestCheck_FindsCorruptionAndGarbage(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("tampered.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("lost.txt", []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	s.Chunks[s.Files[alice.priv.FileIndex["tampered.txt"]].Chunks[0]][15] ^= 0x01
+	delete(s.Chunks, s.Files[alice.priv.FileIndex["lost.txt"]].Chunks[0])
+	stray := uuid.New()
+	s.Chunks[stray] = []byte("stray")
+
+	kinds := func(r *CheckReport) map[string]string {
+		m := map[string]string{}
+		for _, p := range r.Problems {
+			m[p.Kind] = p.Severity
+		}
+		return m
+	}
+
+	// Without credentials only structure is visible.
+	got := kinds(s.Check())
+	if got[ProblemDanglingChunk] != SeverityCorrupt || got[ProblemOrphanChunk] != SeverityGarbage {
+		t.Fatalf("structural check missed problems: %v", got)
+	}
+	if _, ok := got[ProblemAuthFailure]; ok {
+		t.Fatalf("structural check cannot detect tampering without keys")
+	}
+
+	rep := alice.Check()
+	if !rep.Corrupt() {
+		t.Fatalf("expected corruption")
+	}
+	if kinds(rep)[ProblemAuthFailure] != SeverityCorrupt {
+		t.Fatalf("credentialed check missed tampered chunk: %+v", rep.Problems)
+	}
+
+	// Garbage alone is not corruption.
+	s2 := newTempStore(t)
+	s2.Chunks[uuid.New()] = []byte("x")
+	if r := s2.Check(); r.Corrupt() || len(r.Problems) != 1 {
+		t.Fatalf("orphan-only store: %+v", r.Problems)
+	}
+}
+
+// ==========================
+// Store format & migrations
+// ==========================
+
+func TestFormat_MigratesLegacyStoreWithBackup(t *testing.T) {
+	orig, err := os.ReadFile("test_store.json") // written before Format existed
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "store.json")
+	if err := os.WriteFile(p, orig, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatalf("OpenStore(legacy): %v", err)
+	}
+	if s.Format != StoreFormat {
+		t.Fatalf("format not upgraded: %d", s.Format)
+	}
+	backup, err := os.ReadFile(p + ".v0.bak")
+	if err != nil {
+		t.Fatalf("no backup of original: %v", err)
+	}
+	if !bytes.Equal(backup, orig) {
+		t.Fatalf("backup differs from original")
+	}
+	if !s.LegacyKeySchedule {
+		t.Fatalf("migrated store not flagged legacy")
+	}
+	// Its chunks were resealed in the committing format.
+	for id, ct := range s.Chunks {
+		if len(ct) < ctPrefixLen || ct[2] != ctVersion {
+			t.Fatalf("chunk %s not resealed", id)
+		}
+	}
+	if len(s.Users) != 2 || len(s.Files) != 1 || len(s.Chunks) != 2 {
+		t.Fatalf("migration lost data: %d users, %d files, %d chunks", len(s.Users), len(s.Files), len(s.Chunks))
+	}
+	if rep := s.Check(); rep.Corrupt() {
+		t.Fatalf("migrated store fails check: %+v", rep.Problems)
+	}
+
+	// The upgrade was persisted: reopening is a no-op.
+	var head struct{ Format int }
+	b, _ := os.ReadFile(p)
+	if err := json.Unmarshal(b, &head); err != nil || head.Format != StoreFormat {
+		t.Fatalf("upgraded format not on disk: %d, %v", head.Format, err)
+	}
+	if _, err := OpenStore(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormat_RefusesNewerStore(t *testing.T) {
+	for _, f := range []int{StoreFormat + 1, 99} {
+		p := filepath.Join(t.TempDir(), "store.json")
+		if err := os.WriteFile(p, []byte(fmt.Sprintf(`{"Format": %d}`, f)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenStore(p); !errors.Is(err, ErrStoreTooNew) {
+			t.Fatalf("format %d: expected ErrStoreTooNew, got %v", f, err)
+		}
+	}
+}
+
+func TestFormat_RefusesNegativeFormat(t *testing.T) {
+	for _, f := range []int{-1, -1 << 40} {
+		p := filepath.Join(t.TempDir(), "store.json")
+		if err := os.WriteFile(p, []byte(fmt.Sprintf(`{"Format": %d}`, f)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenStore(p); !errors.Is(err, ErrCorruptStore) {
+			t.Fatalf("format %d: expected ErrCorruptStore, got %v", f, err)
+		}
+	}
+}
+
+// ==========================
+// Binary store encoding
+// ==========================
+
+func TestBinary_RoundTripAndConvert(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	if err := alice.StoreFile("big.txt", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	jsonInfo, _ := os.Stat(s.path)
+
+	if err := s.SetEncoding(EncodingBinary); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte("SFSB")) {
+		t.Fatalf("store not written in binary container")
+	}
+	if int64(len(raw)) >= jsonInfo.Size() {
+		t.Fatalf("binary (%d bytes) not smaller than JSON (%d bytes)", len(raw), jsonInfo.Size())
+	}
+
+	s2, err := OpenStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Encoding() != EncodingBinary {
+		t.Fatalf("reopened store has encoding %v", s2.Encoding())
+	}
+	alice2 := mustLogin(t, s2, "alice", "wonder")
+	if got, err := alice2.LoadFile("big.txt"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("binary round trip lost data: %v", err)
+	}
+	// Writes keep the encoding.
+	if err := alice2.AppendFile("big.txt", []byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile(s.path); !bytes.HasPrefix(raw, []byte("SFSB")) {
+		t.Fatalf("save switched encoding")
+	}
+
+	if err := s2.SetEncoding(EncodingJSON); err != nil {
+		t.Fatal(err)
+	}
+	s3, err := OpenStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.Encoding() != EncodingJSON {
+		t.Fatalf("converted store has encoding %v", s3.Encoding())
+	}
+	if got, err := mustLogin(t, s3, "alice", "wonder").LoadFile("big.txt"); err != nil || len(got) != len(data)+1 {
+		t.Fatalf("JSON conversion lost data: %v", err)
+	}
+}
+
+func TestBinary_DetectsCorruptionAndTruncation(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("f.txt", bytes.Repeat([]byte("x"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetEncoding(EncodingBinary); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append([]byte{}, raw...)
+	flipped[len(flipped)-200] ^= 0x01
+	truncated := raw[:len(raw)-10]
+	for name, b := range map[string][]byte{"flipped": flipped, "truncated": truncated} {
+		p := filepath.Join(t.TempDir(), "store.bin")
+		if err := os.WriteFile(p, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenStore(p); !errors.Is(err, ErrCorruptStore) {
+			t.Fatalf("%s: expected ErrCorruptStore, got %v", name, err)
+		}
+	}
+}
+
+// Store load/save throughput. Use -store-mb=1024 for 1 GB stores.
+var benchStoreMB = flag.Int("store-mb", 64, "store size in MB for store benchmarks")
+
+func benchStore(b *testing.B, enc Encoding) *Store {
+	b.Helper()
+	s, err := OpenStore(filepath.Join(b.TempDir(), "store"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	s.encoding = enc
+	chunk := make([]byte, chunkSize)
+	for i := 0; i < *benchStoreMB<<20/chunkSize; i++ {
+		chunk[0], chunk[1], chunk[2] = byte(i), byte(i>>8), byte(i>>16)
+		s.Chunks[uuid.New()] = copyBytes(chunk)
+	}
+	return s
+}
+
+func BenchmarkStoreSave(b *testing.B) {
+	for _, enc := range []Encoding{EncodingJSON, EncodingBinary} {
+		b.Run(enc.String(), func(b *testing.B) {
+			s := benchStore(b, enc)
+			b.SetBytes(int64(*benchStoreMB) << 20)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Save(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStoreLoad(b *testing.B) {
+	for _, enc := range []Encoding{EncodingJSON, EncodingBinary} {
+		b.Run(enc.String(), func(b *testing.B) {
+			s := benchStore(b, enc)
+			if err := s.Save(); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(*benchStoreMB) << 20)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := OpenStore(s.path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ==========================
+// Rollback & fork detection
+// ==========================
+
+func TestEpoch_DetectsRollback(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "store.json")
+	state := WithStateFile(filepath.Join(dir, "client-state.json"))
+	s, err := OpenStore(p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("acl.txt", []byte("bob may read")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("acl.txt", []byte("bob revoked")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening the current store is fine.
+	if _, err := OpenStore(p, state); err != nil {
+		t.Fatalf("reopen current store: %v", err)
+	}
+
+	// Someone puts the older copy back.
+	if err := os.WriteFile(p, old, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(p, state); !errors.Is(err, ErrRollback) {
+		t.Fatalf("expected ErrRollback, got %v", err)
+	}
+	// A client without state cannot tell.
+	if _, err := OpenStore(p); err != nil {
+		t.Fatalf("stateless open: %v", err)
+	}
+}
+
+func TestEpoch_DetectsFork(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "store.json")
+	mine := WithStateFile(filepath.Join(dir, "mine.json"))
+	s, err := OpenStore(p, mine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	base, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We write one branch...
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("x.txt", []byte("ours")); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...while someone else is served the base copy and writes another.
+	theirs := filepath.Join(dir, "theirs.json")
+	if err := os.WriteFile(theirs, base, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	other, err := OpenStore(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mustLogin(t, other, "alice", "wonder").StoreFile("x.txt", []byte("theirs")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same epoch, different history.
+	forked, err := os.ReadFile(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, forked, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(p, mine); !errors.Is(err, ErrFork) {
+		t.Fatalf("expected ErrFork, got %v", err)
+	}
+
+	// Editing the epoch on the fork does not help: the head signature breaks.
+	var doc map[string]any
+	if err := json.Unmarshal(forked, &doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["Epoch"] = doc["Epoch"].(float64) + 5
+	edited, _ := json.Marshal(doc)
+	if err := os.WriteFile(p, edited, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(p, mine); !errors.Is(err, ErrFork) {
+		t.Fatalf("expected ErrFork for edited epoch, got %v", err)
+	}
+}
+
+func TestEpoch_DetectsOldContentUnderCurrentEpoch(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "store.json")
+	state := WithStateFile(filepath.Join(dir, "client-state.json"))
+	s, err := OpenStore(p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("acl.txt", []byte("bob may read")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("acl.txt", []byte("bob revoked")); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Splice the current epoch fields onto the old content.
+	var oldDoc, curDoc map[string]json.RawMessage
+	if err := json.Unmarshal(old, &oldDoc); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(cur, &curDoc); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Epoch", "Nonce", "Heads"} {
+		oldDoc[k] = curDoc[k]
+	}
+	spliced, _ := json.Marshal(oldDoc)
+	if err := os.WriteFile(p, spliced, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(p, state); !errors.Is(err, ErrFork) {
+		t.Fatalf("spliced store: want ErrFork, got %v", err)
+	}
+
+	// Claiming an older format skips head verification, but the digest
+	// remembered in the state file still catches the old content.
+	oldDoc["Format"] = json.RawMessage("4")
+	spliced, _ = json.Marshal(oldDoc)
+	if err := os.WriteFile(p, spliced, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(p, state); !errors.Is(err, ErrRollback) {
+		t.Fatalf("spliced store claiming format 4: want ErrRollback, got %v", err)
+	}
+
+	// The secret is in the store, so an attacker can recompute the HMAC,
+	// but not alice's signature, nor the head the state file remembers.
+	oldDoc["Format"] = curDoc["Format"]
+	spliced, _ = json.Marshal(oldDoc)
+	if err := os.WriteFile(p, spliced, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	forged, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(forged.Heads)
+	digest, err := forged.contentDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Heads[n-1].Head = forged.headFor(forged.Heads[n-2].Head, forged.Epoch, forged.Nonce, digest)
+	if err := writeAtomic(p, forged.encodeTo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(p, state); !errors.Is(err, ErrFork) {
+		t.Fatalf("re-signed splice: want ErrFork, got %v", err)
+	}
+
+	// The genuine current store still opens.
+	if err := os.WriteFile(p, cur, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenStore(p, state)
+	if err != nil {
+		t.Fatalf("reopen current store: %v", err)
+	}
+	if got, err := mustLogin(t, s, "alice", "wonder").LoadFile("acl.txt"); err != nil || string(got) != "bob revoked" {
+		t.Fatalf("current content: %q, %v", got, err)
+	}
+}
+
+func TestEpoch_DetectsRollbackResignedPastRememberedEpoch(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "store.json")
+	state := WithStateFile(filepath.Join(dir, "client-state.json"))
+	s, err := OpenStore(p, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"alice", "bob"} {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, bob := mustLogin(t, s, "alice", "pw"), mustLogin(t, s, "bob", "pw")
+	if err := alice.StoreFile("doc", []byte("before revoke")); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.AcceptShare("doc", code); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Revoke("doc"); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := signingKey(bob.priv.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// forge puts the old copy back under the current epoch fields and
+	// saves it once, as whoever resign names, extending the chain past
+	// the epoch the state file remembers.
+	forge := func(resign func(*Store) error) {
+		t.Helper()
+		var oldDoc, curDoc map[string]json.RawMessage
+		if err := json.Unmarshal(old, &oldDoc); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(cur, &curDoc); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"Epoch", "Nonce", "Heads"} {
+			oldDoc[k] = curDoc[k]
+		}
+		spliced, _ := json.Marshal(oldDoc)
+		if err := os.WriteFile(p, spliced, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		forged, err := OpenStore(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resign(forged); err != nil {
+			t.Fatal(err)
+		}
+		if !forged.verifyHead() {
+			t.Fatalf("forged head should verify against the store secret")
+		}
+	}
+	expect := func(what string, want error) {
+		t.Helper()
+		if _, err := OpenStore(p, state); !errors.Is(err, want) {
+			t.Fatalf("%s, with state: want %v, got %v", what, want, err)
+		}
+		stateless, err := OpenStore(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Login(stateless, "alice", "pw"); !errors.Is(err, want) {
+			t.Fatalf("%s, alice's login: want %v, got %v", what, want, err)
+		}
+	}
+
+	forge(func(f *Store) error { return f.Save() })
+	expect("unsigned save", ErrRollback)
+
+	// A user in on it can sign the new head, but not alice's.
+	forge(func(f *Store) error { return f.saveAs(&headSigner{name: "bob", key: bobKey}) })
+	expect("save signed by bob", ErrRollback)
+
+	// Swapping in a key of one's own to re-sign alice's heads is caught
+	// by the pin in the state file, and by alice herself.
+	forge(func(f *Store) error {
+		pub, key, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			return err
+		}
+		f.Users["alice"].SignKey = pub
+		f.signer = &headSigner{name: "alice", key: key}
+		for i, h := range f.Heads {
+			if h.Signer == "alice" {
+				f.Heads[i] = f.signHead(h)
+			}
+		}
+		return f.saveAs(f.signer)
+	})
+	expect("alice's key swapped", ErrFork)
+
+	// The genuine store still opens and alice still reads.
+	if err := os.WriteFile(p, cur, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenStore(p, state)
+	if err != nil {
+		t.Fatalf("reopen current store: %v", err)
+	}
+	if got, err := mustLogin(t, s, "alice", "pw").LoadFile("doc"); err != nil || string(got) != "before revoke" {
+		t.Fatalf("current content: %q, %v", got, err)
+	}
+}
+
+// ==========================
+// Merkle proofs
+// ==========================
+
+func TestMerkle_InclusionAllSizes(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, leafHash(int64(i), contentHash([]byte("k"), []byte{byte(i)})))
+		}
+		root := merkleRoot(leaves)
+		for m := 0; m < n; m++ {
+			path := auditPath(m, leaves)
+			if !verifyInclusion(m, n, leaves[m], path, root) {
+				t.Fatalf("n=%d m=%d: valid path rejected", n, m)
+			}
+			if verifyInclusion((m+1)%n, n, leaves[m], path, root) && n > 1 {
+				t.Fatalf("n=%d m=%d: path accepted at wrong index", n, m)
+			}
+		}
+	}
+}
+
+func TestMerkle_RangeProofSpansChunks(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*chunkSize/16+100)
+	if err := alice.StoreFile("big.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	root, err := alice.MerkleRoot("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off, n := int64(chunkSize-10), int64(chunkSize+20)
+	p, err := alice.ReadRange("big.bin", off, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Data, data[off:off+n]) || len(p.Chunks) != 3 {
+		t.Fatalf("bad range: %d bytes over %d chunks", len(p.Data), len(p.Chunks))
+	}
+	if err := alice.VerifyRange("big.bin", root, p); err != nil {
+		t.Fatalf("valid proof rejected: %v", err)
+	}
+
+	// A chunk's bytes moved to another offset, altered data, or a wrong
+	// root must all fail.
+	moved := *p
+	moved.Chunks = append([]ChunkProof{}, p.Chunks...)
+	moved.Chunks[0].Offset += 1
+	if err := alice.VerifyRange("big.bin", root, &moved); !errors.Is(err, ErrBadProof) {
+		t.Fatalf("moved chunk accepted: %v", err)
+	}
+	forged := *p
+	forged.Data = append([]byte{}, p.Data...)
+	forged.Data[0] ^= 1
+	if err := alice.VerifyRange("big.bin", root, &forged); !errors.Is(err, ErrBadProof) {
+		t.Fatalf("forged data accepted: %v", err)
+	}
+	if err := alice.AppendFile("big.bin", []byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.VerifyRange("big.bin", root, p); err != nil {
+		t.Fatalf("proof against the root it was issued for: %v", err)
+	}
+	newRoot, _ := alice.MerkleRoot("big.bin")
+	if err := alice.VerifyRange("big.bin", newRoot, p); !errors.Is(err, ErrBadProof) {
+		t.Fatalf("stale proof accepted against new root: %v", err)
+	}
+}
+
+func TestMerkle_ReadRangeBounds(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("f", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		name   string
+		off, n int64
+	}{
+		{"f", 1, math.MaxInt64}, // off+n overflows
+		{"f", math.MaxInt64, 1},
+		{"f", 6, 0},
+		{"f", -1, 1},
+		{"f", 0, -1},
+		{"empty", 0, 1},
+	} {
+		if _, err := alice.ReadRange(r.name, r.off, r.n); err == nil {
+			t.Fatalf("ReadRange(%q, %d, %d) succeeded", r.name, r.off, r.n)
+		}
+	}
+	for _, name := range []string{"f", "empty"} {
+		p, err := alice.ReadRange(name, 0, 0)
+		if err != nil || len(p.Data) != 0 || len(p.Chunks) != 0 {
+			t.Fatalf("empty range of %q: %+v %v", name, p, err)
+		}
+	}
+}
+
+func TestMerkle_FileDigestComparesContent(t *testing.T) {
+	s := newTempStore(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := Signup(s, u, "pw-"+u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw-alice")
+	bob := mustLogin(t, s, "bob", "pw-bob")
+	data := bytes.Repeat([]byte("x"), chunkSize+500)
+
+	if err := alice.StoreFile("a", data); err != nil {
+		t.Fatal(err)
+	}
+	// Bob builds the same bytes through appends, so his chunking differs.
+	if err := bob.StoreFile("b", data[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.AppendFile("b", data[100:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.StoreFile("c", append(append([]byte{}, data[:len(data)-1]...), 'y')); err != nil {
+		t.Fatal(err)
+	}
+
+	agreed := []byte("alice and bob's comparison key")
+	da, err := alice.FileDigest("a", agreed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := bob.FileDigest("b", agreed)
+	dc, _ := bob.FileDigest("c", agreed)
+	if !bytes.Equal(da, db) {
+		t.Fatalf("equal content, different digests")
+	}
+	if bytes.Equal(da, dc) {
+		t.Fatalf("different content, equal digests")
+	}
+	if other, _ := bob.FileDigest("b", []byte("another key")); bytes.Equal(other, db) {
+		t.Fatalf("digest does not depend on the key")
+	}
+	if _, err := bob.FileDigest("b", nil); err == nil {
+		t.Fatalf("empty digest key accepted")
+	}
+}
+
+func TestMerkle_StoredHashesDoNotConfirmGuesses(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	pin := []byte("pin 1234")
+	if err := alice.StoreFile("secret", pin); err != nil {
+		t.Fatal(err)
+	}
+	rec := s.Files[alice.priv.FileIndex["secret"]]
+
+	// Someone reading the store guesses the content and hashes it.
+	guess := sha256.Sum256(pin)
+	if bytes.Equal(rec.Hashes[0], guess[:]) {
+		t.Fatalf("stored chunk hash is the unkeyed SHA-256 of the content")
+	}
+	unkeyed := merkleRoot([][]byte{leafHash(0, guess[:])})
+	if bytes.Equal(rec.Root, unkeyed) {
+		t.Fatalf("Merkle root confirms the guessed content")
+	}
+
+	// Rotating the key rehashes, and proofs still verify.
+	before := copyBytes(rec.Root)
+	if err := alice.Revoke("secret"); err != nil {
+		t.Fatal(err)
+	}
+	root, err := alice.MerkleRoot("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(root, before) {
+		t.Fatalf("root unchanged by key rotation")
+	}
+	p, err := alice.ReadRange("secret", 0, int64(len(pin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.VerifyRange("secret", root, p); err != nil {
+		t.Fatalf("proof after revoke: %v", err)
+	}
+	if r := alice.Check(); r.Corrupt() {
+		t.Fatalf("check after revoke: %+v", r.Problems)
+	}
+}
+
+func TestMerkle_MigrationRehashesUnkeyedHashes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("f", []byte("old hashes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableHistory("f", RetentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("f", []byte(", more")); err != nil {
+		t.Fatal(err)
+	}
+	// Rewrite as a format 5 store with unkeyed hashes.
+	rec := s.Files[alice.priv.FileIndex["f"]]
+	unkeyed := func(ids []uuid.UUID) [][]byte {
+		var out [][]byte
+		for _, id := range ids {
+			pt := must(s.openChunk(rec.Key, s.Chunks[id]))
+			h := sha256.Sum256(pt)
+			out = append(out, h[:])
+		}
+		return out
+	}
+	rec.Hashes = unkeyed(rec.Chunks)
+	rec.History.Versions[0].Hashes = unkeyed(rec.History.Versions[0].Chunks)
+	rec.Root = merkleRoot(rec.leaves())
+	s.Format = 5
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice = mustLogin(t, s, "alice", "wonder")
+	if r := alice.Check(); len(r.Problems) != 0 {
+		t.Fatalf("migrated store: %+v", r.Problems)
+	}
+	root, err := alice.MerkleRoot("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := alice.ReadRange("f", 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.VerifyRange("f", root, proof); err != nil {
+		t.Fatalf("proof after migration: %v", err)
+	}
+	if err := alice.RestoreVersion("f", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := alice.LoadFile("f"); err != nil || string(got) != "old hashes" {
+		t.Fatalf("restored version: %q, %v", got, err)
+	}
+	if r := alice.Check(); len(r.Problems) != 0 {
+		t.Fatalf("after restore: %+v", r.Problems)
+	}
+}
+
+func TestMerkle_CheckFindsHashMismatch(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	rec := s.Files[alice.priv.FileIndex["a.txt"]]
+	// Swap in a validly encrypted chunk with different content.
+	s.Chunks[rec.Chunks[0]] = must(s.sealEnvelope(rec.Key, CodecNone, nil, []byte("jello")))
+	found := false
+	for _, p := range alice.Check().Problems {
+		found = found || p.Kind == ProblemHashMismatch
+	}
+	if !found {
+		t.Fatalf("substituted chunk not reported")
+	}
+}
+
+// ==========================
+// Deduplication
+// ==========================
+
+func pseudoRandom(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestDedup_RepeatedAppendsStoredOnce(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	block := pseudoRandom(40<<10, 1)
+	if err := alice.StoreFile("log", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableDedup("log"); err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for i := 0; i < 5; i++ {
+		if err := alice.AppendFile("log", block); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, block...)
+	}
+	got, err := alice.LoadFile("log")
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("content mismatch: %v", err)
+	}
+	rec := s.Files[alice.priv.FileIndex["log"]]
+	if len(s.Chunks) >= len(rec.Chunks) {
+		t.Fatalf("expected sharing: %d chunks stored for %d references", len(s.Chunks), len(rec.Chunks))
+	}
+	if len(rec.liveChunks()) != len(s.Chunks) {
+		t.Fatalf("stored chunks should be exactly the distinct ones")
+	}
+}
+
+func TestDedup_RewriteReusesUnchangedRegions(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	data := pseudoRandom(1<<20, 2)
+	if err := alice.StoreFile("big", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableDedup("big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableHistory("big", RetentionPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	before := len(s.Chunks)
+	rec := s.Files[alice.priv.FileIndex["big"]]
+	for i := range rec.Chunks {
+		if n := rec.chunkLen(i); n > chunkSize || (n < cdcMin && i < len(rec.Chunks)-1) {
+			t.Fatalf("chunk %d has %d bytes", i, n)
+		}
+	}
+
+	// Insert a few bytes near the front: boundaries resynchronise, so the
+	// new version shares almost every chunk with the retained one.
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+	if err := alice.StoreFile("big", edited); err != nil {
+		t.Fatal(err)
+	}
+	if added := len(s.Chunks) - before; added > 3 {
+		t.Fatalf("insert added %d chunks out of %d", added, before)
+	}
+	got, err := alice.LoadFile("big")
+	if err != nil || !bytes.Equal(got, edited) {
+		t.Fatalf("content mismatch: %v", err)
+	}
+	old, err := alice.LoadVersion("big", 1)
+	if err != nil || !bytes.Equal(old, data) {
+		t.Fatalf("version mismatch: %v", err)
+	}
+}
+
+func TestDedup_SharedChunksFreedByRefcount(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	data := pseudoRandom(200<<10, 3)
+	if err := alice.StoreFile("a", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableDedup("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	// The same name gets the same file key, so the new record's chunks
+	// are the unreachable old record's chunks.
+	if err := alice.StoreFile("a", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableDedup("a"); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting the new record must not free chunks the old one holds.
+	if err := alice.StoreFile("a", []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if rep := s.Check(); rep.Corrupt() {
+		t.Fatalf("shared chunk freed early: %+v", rep.Problems)
+	}
+	rep, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Files != 1 || rep.Chunks == 0 {
+		t.Fatalf("GC should reclaim the old record and its chunks: %+v", rep)
+	}
+	if r := alice.Check(); len(r.Problems) != 0 {
+		t.Fatalf("after GC: %+v", r.Problems)
+	}
+}
+
+func TestDedup_RevokeKeepsContentAddressing(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	block := pseudoRandom(30<<10, 4)
+	if err := alice.StoreFile("a", append(append([]byte{}, block...), block...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.EnableDedup("a"); err != nil {
+		t.Fatal(err)
+	}
+	n := len(s.Chunks)
+	if err := alice.Revoke("a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Chunks) != n {
+		t.Fatalf("revoke changed chunk count %d -> %d", n, len(s.Chunks))
+	}
+	for _, id := range s.Files[alice.priv.FileIndex["a"]].Chunks {
+		if !isContentID(id) {
+			t.Fatalf("chunk %s lost content addressing", id)
+		}
+	}
+	got, err := alice.LoadFile("a")
+	if err != nil || !bytes.Equal(got, append(append([]byte{}, block...), block...)) {
+		t.Fatalf("content mismatch: %v", err)
+	}
+}
+
+func TestDedup_KeptRefcountsMatchRecount(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	block := pseudoRandom(30<<10, 5)
+	twice := append(append([]byte{}, block...), block...)
+	steps := []struct {
+		name string
+		do   func() error
+	}{
+		{"store", func() error { return alice.StoreFile("a", twice) }},
+		{"dedup", func() error { return alice.EnableDedup("a") }},
+		{"history", func() error { return alice.EnableHistory("a", RetentionPolicy{KeepVersions: 2}) }},
+		{"append", func() error { return alice.AppendFile("a", block) }},
+		{"snapshot", func() error { return alice.Snapshot("s") }},
+		{"write", func() error { return alice.WriteAt("a", 10, []byte("changed")) }},
+		{"truncate", func() error { return alice.Truncate("a", int64(len(block))) }},
+		{"restore version", func() error { return alice.RestoreVersion("a", 2) }},
+		{"revoke", func() error { return alice.Revoke("a") }},
+		{"restore snapshot", func() error { return alice.RestoreSnapshotFile("s", "a") }},
+		{"delete snapshot", func() error { return alice.DeleteSnapshot("s") }},
+		{"disable history", func() error { return alice.DisableHistory("a") }},
+		{"delete", func() error { return alice.Delete("a") }},
+		{"gc", func() error { _, err := s.GC(); return err }},
+	}
+	for _, st := range steps {
+		if err := st.do(); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		for _, p := range s.Check().Problems {
+			if p.Kind == ProblemBadRefcount || p.Kind == ProblemDanglingChunk {
+				t.Fatalf("after %s: %+v", st.name, p)
+			}
+		}
+	}
+	if len(s.Chunks) != 0 || len(s.Refs) != 0 {
+		t.Fatalf("left %d chunks, %d counts", len(s.Chunks), len(s.Refs))
+	}
+
+	// A wrong count is reported, and GC repairs it.
+	if err := alice.StoreFile("b", block); err != nil {
+		t.Fatal(err)
+	}
+	id := s.Files[alice.priv.FileIndex["b"]].Chunks[0]
+	s.Refs[id] = 7
+	if r := s.Check(); !r.Corrupt() {
+		t.Fatalf("bad count not reported")
+	}
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Refs[id] != 1 || s.Check().Corrupt() {
+		t.Fatalf("GC did not recount: %d", s.Refs[id])
+	}
+}
+
+// ==========================
+// Compression
+// ==========================
+
+func TestCompression_ShrinksTextAndRoundTrips(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	text := bytes.Repeat([]byte("2025-01-01T00:00:00Z INFO request served in 3ms\n"), 4000)
+	noise := pseudoRandom(100<<10, 5)
+	for _, name := range []string{"plain.log", "small.log", "noise.bin"} {
+		if err := alice.StoreFile(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.SetCompression("small.log", CodecDeflate); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetCompression("noise.bin", CodecDeflate); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"plain.log": text, "small.log": text, "noise.bin": noise} {
+		if err := alice.AppendFile(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := func(name string) (n int) {
+		for _, id := range s.Files[alice.priv.FileIndex[name]].Chunks {
+			n += len(s.Chunks[id])
+		}
+		return n
+	}
+	if p, c := stored("plain.log"), stored("small.log"); c*5 > p {
+		t.Fatalf("compressed %d bytes vs %d plain", c, p)
+	}
+	// Incompressible chunks fall back to the raw codec.
+	if n := stored("noise.bin"); n > len(noise)+2*(ctHeaderLen+12+16+1) {
+		t.Fatalf("noise grew to %d bytes", n)
+	}
+	for name, want := range map[string][]byte{"plain.log": text, "small.log": text, "noise.bin": noise} {
+		got, err := alice.LoadFile(name)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: mismatch: %v", name, err)
+		}
+	}
+	r, err := alice.Open("small.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 48)
+	if _, err := r.ReadAt(buf, 48*3000); err != nil || !bytes.Equal(buf, text[:48]) {
+		t.Fatalf("random access into compressed file: %q %v", buf, err)
+	}
+	if rep := alice.Check(); len(rep.Problems) != 0 {
+		t.Fatalf("check: %+v", rep.Problems)
+	}
+}
+
+func TestCompression_EnvelopeIsAuthenticated(t *testing.T) {
+	key := must(RandomBytes(32))
+	s := &Store{}
+	// An unknown codec tag or an oversized inflation is refused.
+	if _, err := s.openChunk(key, must(seal(crand.Reader, SuiteAESGCM, key, []byte{9, 'x'}, chunkAD))); err == nil {
+		t.Fatalf("unknown codec accepted")
+	}
+	bomb := must(s.sealEnvelope(key, CodecDeflate, nil, make([]byte, 4*chunkSize)))
+	if _, err := s.openChunk(key, bomb); err == nil {
+		t.Fatalf("oversized chunk accepted")
+	}
+	// A legacy chunk reads as raw plaintext when migrating; an envelope
+	// is never taken for one, so its tag byte cannot leak into the content.
+	if pt, err := openLegacyChunk(key, legacyEnc(key, []byte("legacy"))); err != nil || string(pt) != "legacy" {
+		t.Fatalf("legacy chunk: %q %v", pt, err)
+	}
+	if _, err := s.openChunk(key, legacyEnc(key, []byte("legacy"))); err == nil {
+		t.Fatalf("legacy chunk read outside migration")
+	}
+	if pt, err := s.openChunk(key, must(s.sealEnvelope(key, CodecNone, nil, []byte("new")))); err != nil || string(pt) != "new" {
+		t.Fatalf("envelope: %q %v", pt, err)
+	}
+	if _, err := ParseCodec("zstd"); err == nil {
+		t.Fatalf("unknown codec name parsed")
+	}
+}
+
+// ==========================
+// Padding
+// ==========================
+
+func TestPadding_PoliciesHideLengths(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	const overhead = ctHeaderLen + 12 + 16 // header, nonce and GCM tag
+	sizes := []int{1, 100, 1000, 3000, 70000}
+
+	cases := []struct {
+		policy PaddingPolicy
+		want   func(envelope int) bool
+	}{
+		{PaddingPolicy{Mode: PadPow2}, func(n int) bool { return n&(n-1) == 0 }},
+		{PaddingPolicy{Mode: PadBuckets, Buckets: []int{1024, 8192}}, func(n int) bool { return n%1024 == 0 }},
+		{PaddingPolicy{Mode: PadFixed}, func(n int) bool { return n == padHeader+chunkSize }},
+	}
+	for _, tc := range cases {
+		name := tc.policy.Mode.String()
+		if err := alice.StoreFile(name, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := alice.SetPadding(name, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+		var want []byte
+		for i, n := range sizes {
+			data := pseudoRandom(n, int64(i))
+			if err := alice.AppendFile(name, data); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, data...)
+		}
+		for _, id := range s.Files[alice.priv.FileIndex[name]].Chunks {
+			if n := len(s.Chunks[id]) - overhead; !tc.want(n) {
+				t.Fatalf("%s: envelope of %d bytes", name, n)
+			}
+		}
+		got, err := alice.LoadFile(name)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: content mismatch: %v", name, err)
+		}
+		fi, err := alice.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size != int64(len(want)) || fi.Stored <= fi.Size || fi.Padding.Mode != tc.policy.Mode {
+			t.Fatalf("%s: stat %+v", name, fi)
+		}
+	}
+
+	if err := alice.SetPadding(PadFixed.String(), PaddingPolicy{Mode: PadBuckets}); err == nil {
+		t.Fatalf("bucket policy without buckets accepted")
+	}
+	if err := alice.SetPadding(PadFixed.String(), PaddingPolicy{Mode: PadBuckets, Buckets: []int{4096, 1024}}); err == nil {
+		t.Fatalf("unsorted buckets accepted")
+	}
+}
+
+func TestPadding_SettingsSurviveSnapshotRestore(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("f", []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	policy := PaddingPolicy{Mode: PadFixed}
+	retain := RetentionPolicy{KeepVersions: 4}
+	for _, err := range []error{
+		alice.SetPadding("f", policy),
+		alice.SetCompression("f", CodecDeflate),
+		alice.EnableHistory("f", retain),
+		alice.EnableDedup("f"),
+		alice.Snapshot("s"),
+		alice.Delete("f"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rep, err := s.GC(); err != nil || rep.Files != 1 {
+		t.Fatalf("record not collected: %+v, %v", rep, err)
+	}
+	if err := alice.RestoreSnapshotFile("s", "f"); err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("compressible "), 100)
+	if err := alice.AppendFile("f", text); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := alice.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Padding.Mode != PadFixed || fi.Compression != CodecDeflate || !fi.History || !fi.Dedup {
+		t.Fatalf("settings lost in restore: %+v", fi)
+	}
+	rec := s.Files[alice.priv.FileIndex["f"]]
+	if rec.History.Policy != retain {
+		t.Fatalf("retention policy: %+v", rec.History.Policy)
+	}
+	const overhead = ctHeaderLen + 12 + 16
+	last := rec.Chunks[len(rec.Chunks)-1]
+	if n := len(s.Chunks[last]) - overhead; n != padHeader+chunkSize {
+		t.Fatalf("append after restore is not padded: envelope of %d bytes", n)
+	}
+	if vs, _ := alice.ListVersions("f"); len(vs) != 1 {
+		t.Fatalf("append after restore recorded %d versions", len(vs))
+	}
+	got, err := alice.LoadFile("f")
+	if err != nil || !bytes.Equal(got, append([]byte("short"), text...)) {
+		t.Fatalf("content: %q, %v", got, err)
+	}
+}
+
+func TestPadding_CombinesWithCompression(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetCompression("a", CodecDeflate); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetPadding("a", PaddingPolicy{Mode: PadPow2}); err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("abc"), 10000)
+	if err := alice.AppendFile("a", text); err != nil {
+		t.Fatal(err)
+	}
+	got, err := alice.LoadFile("a")
+	if err != nil || !bytes.Equal(got, text) {
+		t.Fatalf("content mismatch: %v", err)
+	}
+	if rep := alice.Check(); len(rep.Problems) != 0 {
+		t.Fatalf("check: %+v", rep.Problems)
+	}
+}
+
+// ==========================
+// Cipher suites
+// ==========================
+
+func TestCipher_MixedSuitesStayReadable(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("a", []byte("sealed with aes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCipher(SuiteXChaCha20Poly1305); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("a", []byte(", then xchacha")); err != nil {
+		t.Fatal(err)
+	}
+	rec := s.Files[alice.priv.FileIndex["a"]]
+	first, second := s.Chunks[rec.Chunks[0]], s.Chunks[rec.Chunks[1]]
+	if Suite(first[3]) != SuiteAESGCM || Suite(second[3]) != SuiteXChaCha20Poly1305 {
+		t.Fatalf("headers name suites %d and %d", first[3], second[3])
+	}
+	// 24-byte nonce for XChaCha20-Poly1305
+	if want := ctHeaderLen + 24 + 16 + 1 + len(", then xchacha"); len(second) != want {
+		t.Fatalf("xchacha chunk is %d bytes, want %d", len(second), want)
+	}
+
+	s2, err := OpenStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.CipherSuite() != SuiteXChaCha20Poly1305 {
+		t.Fatalf("store default not persisted: %s", s2.CipherSuite())
+	}
+	alice2 := mustLogin(t, s2, "alice", "wonder")
+	got, err := alice2.LoadFile("a")
+	if err != nil || string(got) != "sealed with aes, then xchacha" {
+		t.Fatalf("mixed file: %q %v", got, err)
+	}
+	if Suite(s2.Users["alice"].EncUser[3]) != SuiteXChaCha20Poly1305 {
+		t.Fatalf("user state not resealed under the new default")
+	}
+}
+
+func TestCipher_HeaderIsAuthenticated(t *testing.T) {
+	key := must(RandomBytes(32))
+	ct := must(seal(crand.Reader, SuiteXChaCha20Poly1305, key, []byte("payload"), nil))
+	for i := 0; i < ctHeaderLen; i++ {
+		bad := append([]byte{}, ct...)
+		bad[i] ^= 0x01
+		if _, err := symDecAD(key, bad, nil); err == nil {
+			t.Fatalf("header byte %d altered without detection", i)
+		}
+	}
+	// Relabelling a ciphertext as another suite fails too.
+	bad := append([]byte{}, ct...)
+	bad[3] = byte(SuiteAESGCM)
+	if _, err := symDecAD(key, bad, nil); err == nil {
+		t.Fatalf("suite swap accepted")
+	}
+	if err := newTempStore(t).SetCipher(Suite(9)); err == nil {
+		t.Fatalf("unknown suite accepted")
+	}
+	if s, err := ParseSuite(SuiteXChaCha20Poly1305.String()); err != nil || s != SuiteXChaCha20Poly1305 {
+		t.Fatalf("ParseSuite: %v %v", s, err)
+	}
+}
+
+// ==========================
+// Key commitment
+// ==========================
+
+// gfMul multiplies in GCM's GF(2^128) (NIST SP 800-38D, algorithm 1).
+func gfMul(x, y [16]byte) [16]byte {
+	var z [16]byte
+	v := y
+	for i := 0; i < 128; i++ {
+		if x[i/8]>>(7-i%8)&1 == 1 {
+			for k := range z {
+				z[k] ^= v[k]
+			}
+		}
+		lsb := v[15] & 1
+		for k := 15; k > 0; k-- {
+			v[k] = v[k]>>1 | v[k-1]<<7
+		}
+		v[0] >>= 1
+		if lsb == 1 {
+			v[0] ^= 0xe1
+		}
+	}
+	return z
+}
+
+// gfInv returns x^(2^128-2), the inverse of x.
+func gfInv(x [16]byte) [16]byte {
+	r := [16]byte{0x80} // one
+	for i := 0; i < 127; i++ {
+		r = gfMul(gfMul(r, r), x)
+	}
+	return gfMul(r, r)
+}
+
+func gfXor(a, b [16]byte) [16]byte {
+	for k := range a {
+		a[k] ^= b[k]
+	}
+	return a
+}
+
+func aesBlock(key []byte, in [16]byte) [16]byte {
+	b, _ := aes.NewCipher(key)
+	var out [16]byte
+	b.Encrypt(out[:], in[:])
+	return out
+}
+
+// salamander builds an AES-GCM ciphertext and tag that authenticate under
+// both k1 and k2 with the same nonce and associated data. The first
+// ciphertext block makes the k1 plaintext start with want; the second is
+// solved for so the two tags coincide.
+func salamander(k1, k2, nonce, ad, want []byte) []byte {
+	var j0, ctr2 [16]byte
+	copy(j0[:], nonce)
+	j0[15] = 1
+	copy(ctr2[:], nonce)
+	ctr2[15] = 2
+
+	var c1 [16]byte
+	ks := aesBlock(k1, ctr2)
+	for k := range c1 {
+		c1[k] = ks[k]
+		if k < len(want) {
+			c1[k] ^= want[k]
+		}
+	}
+
+	var blocks [][16]byte
+	for i := 0; i < len(ad); i += 16 {
+		var b [16]byte
+		copy(b[:], ad[i:])
+		blocks = append(blocks, b)
+	}
+	free := len(blocks) + 1
+	var lens [16]byte
+	binary.BigEndian.PutUint64(lens[:8], uint64(len(ad))*8)
+	binary.BigEndian.PutUint64(lens[8:], 32*8)
+	blocks = append(blocks, c1, [16]byte{}, lens)
+
+	ghash := func(h [16]byte) [16]byte {
+		var y [16]byte
+		for _, x := range blocks {
+			y = gfMul(gfXor(y, x), h)
+		}
+		return y
+	}
+	pow := func(h [16]byte, e int) [16]byte {
+		r := [16]byte{0x80}
+		for i := 0; i < e; i++ {
+			r = gfMul(r, h)
+		}
+		return r
+	}
+	h1, h2 := aesBlock(k1, [16]byte{}), aesBlock(k2, [16]byte{})
+	e1, e2 := aesBlock(k1, j0), aesBlock(k2, j0)
+	exp := len(blocks) - free
+	rhs := gfXor(gfXor(ghash(h1), ghash(h2)), gfXor(e1, e2))
+	c2 := gfMul(rhs, gfInv(gfXor(pow(h1, exp), pow(h2, exp))))
+	blocks[free] = c2
+	tag := gfXor(ghash(h1), e1)
+
+	return append(append(c1[:], c2[:]...), tag[:]...)
+}
+
+func TestCommitment_LegacyGCMIsNotCommitting(t *testing.T) {
+	k1, k2, nonce := must(RandomBytes(32)), must(RandomBytes(32)), must(RandomBytes(12))
+	ct := append(append([]byte{}, nonce...), salamander(k1, k2, nonce, nil, []byte("pay alice"))...)
+
+	// The attack is real against bare AES-GCM: one ciphertext, two keys,
+	// two plaintexts.
+	p1, err1 := openLegacy(k1, ct, nil)
+	p2, err2 := openLegacy(k2, ct, nil)
+	if err1 != nil || err2 != nil || bytes.Equal(p1, p2) || !bytes.HasPrefix(p1, []byte("pay alice")) {
+		t.Fatalf("salamander construction broken: %v %v", err1, err2)
+	}
+	// Stores refuse the format.
+	if _, err := newTempStore(t).openChunk(k2, ct); !errors.Is(err, errNotCommitting) {
+		t.Fatalf("non-committing ciphertext accepted: %v", err)
+	}
+}
+
+func TestCommitment_LegacyFlagOnNewStoreIsIgnored(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustLogin(t, s, "alice", "wonder").StoreFile("doc", []byte("placeholder")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever can write the file swaps in a salamander chunk under the
+	// record's key and sets the flag older builds trusted.
+	k2, nonce := must(RandomBytes(32)), must(RandomBytes(12))
+	var root uuid.UUID
+	for r := range s.Files {
+		root = r
+	}
+	rec := s.Files[root]
+	id := rec.Chunks[0]
+	s.Chunks[id] = append(append([]byte{}, nonce...), salamander(rec.Key, k2, nonce, nil, []byte("pay alice"))...)
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["LegacyCiphertexts"] = json.RawMessage("true")
+	b, _ = json.Marshal(doc)
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mustLogin(t, s, "alice", "wonder").LoadFile("doc"); !errors.Is(err, errNotCommitting) {
+		t.Fatalf("salamander chunk accepted under the flag: %v", err)
+	}
+}
+
+func TestCommitment_MultiKeyChunkFails(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("doc", []byte("placeholder")); err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Users["alice"].EncUser[2]; v != ctVersion {
+		t.Fatalf("user state sealed with header version %d", v)
+	}
+
+	// A malicious sharer builds a committed-format chunk whose inner
+	// AES-GCM layer opens under the derived keys for both k1 and k2,
+	// hoping to hand out two share codes that show different content.
+	k1, k2, nonce := must(RandomBytes(32)), must(RandomBytes(32)), must(RandomBytes(12))
+	prefix := []byte{ctMagic[0], ctMagic[1], ctVersion, byte(SuiteAESGCM)}
+	commitment, ek1 := commitKeys(k1, prefix, nonce)
+	_, ek2 := commitKeys(k2, prefix, nonce)
+	hdr := append(prefix, commitment...)
+	body := salamander(ek1, ek2, nonce, append(append([]byte{}, hdr...), chunkAD...), []byte{0, 'p', 'a', 'y'})
+	ct := append(append(append([]byte{}, hdr...), nonce...), body...)
+
+	for _, ek := range [][]byte{ek1, ek2} {
+		b, _ := aes.NewCipher(ek)
+		g, _ := cipher.NewGCM(b)
+		if _, err := g.Open(nil, nonce, body, append(append([]byte{}, hdr...), chunkAD...)); err != nil {
+			t.Fatalf("inner layer should open under both derived keys: %v", err)
+		}
+	}
+
+	rec := s.Files[alice.priv.FileIndex["doc"]]
+	for _, id := range rec.Chunks {
+		delete(s.Chunks, id)
+	}
+	id := uuid.New()
+	s.Chunks[id] = ct
+	rec.Chunks, rec.Offsets, rec.Hashes = []uuid.UUID{id}, nil, nil
+
+	rec.Key = k1
+	if got, err := alice.LoadFile("doc"); err != nil || !bytes.HasPrefix(got, []byte("pay")) {
+		t.Fatalf("committed key should open: %q %v", got, err)
+	}
+	// A second key, should one ever be installed, fails the commitment.
+	rec.Key = k2
+	if _, err := alice.LoadFile("doc"); !errors.Is(err, errKeyCommitment) {
+		t.Fatalf("second key accepted: %v", err)
+	}
+}
+
+// ==========================
+// Crypto error handling
+// ==========================
+
+// failingRand returns n good bytes and then an error.
+type failingRand struct{ n int }
+
+func (f *failingRand) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("entropy source failed")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	f.n -= len(p)
+	return crand.Read(p)
+}
+
+func TestCrypto_MalformedKeysReturnErrors(t *testing.T) {
+	for _, n := range []int{0, 16, 31, 33} {
+		key := make([]byte, n)
+		for _, suite := range []Suite{SuiteAESGCM, SuiteXChaCha20Poly1305} {
+			if _, err := seal(crand.Reader, suite, key, []byte("x"), nil); err == nil {
+				t.Fatalf("%s sealed with a %d-byte key", suite, n)
+			}
+		}
+		ct := must(seal(crand.Reader, SuiteAESGCM, must(RandomBytes(32)), []byte("x"), nil))
+		if _, err := symDecAD(key, ct, nil); err == nil {
+			t.Fatalf("opened with a %d-byte key", n)
+		}
+		if _, err := open(key, ct[ctHeaderLen:], nil, true); err == nil {
+			t.Fatalf("legacy path opened with a %d-byte key", n)
+		}
+	}
+	if _, err := seal(crand.Reader, Suite(9), make([]byte, 32), nil, nil); err == nil {
+		t.Fatalf("unknown suite sealed")
+	}
+
+	// A record whose key was damaged fails cleanly instead of panicking.
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	rec := s.Files[alice.priv.FileIndex["a"]]
+	rec.Key = rec.Key[:7]
+	if _, err := alice.LoadFile("a"); err == nil {
+		t.Fatalf("load with short key succeeded")
+	}
+	if err := alice.AppendFile("a", []byte("more")); err == nil {
+		t.Fatalf("append with short key succeeded")
+	}
+	if err := alice.StoreFile("a", []byte("new")); err == nil {
+		t.Fatalf("overwrite with short key succeeded")
+	}
+}
+
+func TestCrypto_EntropyFailurePropagates(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "store.json")
+	if _, err := OpenStore(p, WithRand(&failingRand{})); err == nil {
+		t.Fatalf("new store created without entropy")
+	}
+
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "wonder"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "wonder")
+	if err := alice.StoreFile("a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := len(s.Chunks)
+
+	// Enough randomness for one chunk nonce, then none: the second chunk
+	// fails and the first must not be left behind.
+	s.rand = &failingRand{n: 12}
+	if err := alice.AppendFile("a", pseudoRandom(chunkSize+10, 6)); err == nil {
+		t.Fatalf("append succeeded without entropy")
+	}
+	if err := Signup(s, "bob", "builder"); err == nil {
+		t.Fatalf("signup succeeded without entropy")
+	}
+	if len(s.Chunks) != chunks {
+		t.Fatalf("failed append left %d stray chunks", len(s.Chunks)-chunks)
+	}
+	if got, err := alice.LoadFile("a"); err != nil || string(got) != "hello" {
+		t.Fatalf("content after failed append: %q %v", got, err)
+	}
+	after, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("store file changed by failed writes")
+	}
+}
+
+// ==========================
+// Deterministic mode: golden files & known answers
+// ==========================
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite golden_store.json and kat_vectors.json")
+
+// detRand is a reproducible byte stream: SHA-256(seed || counter) blocks.
+type detRand struct {
+	seed []byte
+	ctr  uint64
+	buf  []byte
+}
+
+func (r *detRand) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		if len(r.buf) == 0 {
+			h := sha256.New()
+			h.Write(r.seed)
+			binary.Write(h, binary.BigEndian, r.ctr)
+			r.buf = h.Sum(nil)
+			r.ctr++
+		}
+		k := copy(p[n:], r.buf)
+		r.buf = r.buf[k:]
+		n += k
+	}
+	return len(p), nil
+}
+
+// deterministicStore opens path with seeded randomness, sequential
+// version-4 UUIDs and a clock that ticks one second per reading.
+func deterministicStore(t *testing.T, path string) *Store {
+	t.Helper()
+	var n uint64
+	ids := func() uuid.UUID {
+		n++
+		var id uuid.UUID
+		binary.BigEndian.PutUint64(id[8:], n)
+		id[6], id[8] = 0x40, id[8]|0x80
+		return id
+	}
+	tick := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		tick = tick.Add(time.Second)
+		return tick
+	}
+	s, err := OpenStore(path, WithRand(&detRand{seed: []byte("securefs golden")}), WithUUIDs(ids), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// goldenScenario exercises most record features against a deterministic
+// store and returns the resulting file.
+func goldenScenario(t *testing.T) []byte {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "store.json")
+	s := deterministicStore(t, p)
+	for _, u := range []string{"alice", "bob"} {
+		if err := Signup(s, u, "pw-"+u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw-alice")
+	bob := mustLogin(t, s, "bob", "pw-bob")
+	steps := []func() error{
+		func() error { return alice.StoreFile("notes.txt", []byte("hello")) },
+		func() error { return alice.EnableHistory("notes.txt", RetentionPolicy{KeepVersions: 3}) },
+		func() error { return alice.AppendFile("notes.txt", []byte(" world")) },
+		func() error {
+			code, err := alice.CreateShare("notes.txt")
+			if err != nil {
+				return err
+			}
+			return bob.AcceptShare("shared.txt", code)
+		},
+		func() error { return alice.StoreFile("log", bytes.Repeat([]byte("tick\n"), 5000)) },
+		func() error { return alice.EnableDedup("log") },
+		func() error { return alice.StoreFile("secret", []byte("pin 1234")) },
+		func() error { return alice.SetPadding("secret", PaddingPolicy{Mode: PadPow2}) },
+		func() error { return alice.AppendFile("secret", []byte(", puk 5678")) },
+		func() error { return alice.Snapshot("v1") },
+		func() error { return alice.WriteAt("notes.txt", 0, []byte("HELLO")) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGolden_StoreIsByteForByteReproducible(t *testing.T) {
+	a, b := goldenScenario(t), goldenScenario(t)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("same calls produced different stores")
+	}
+	if *updateGolden {
+		if err := os.WriteFile("golden_store.json", a, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile("golden_store.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, want) {
+		t.Fatalf("store differs from golden_store.json; if the format change is intended, rerun with -update-golden")
+	}
+
+	// The golden store is a real store. Open a copy: logging in and
+	// loading may write the file back, and the fixture must stay as is.
+	p := filepath.Join(t.TempDir(), "golden_store.json")
+	if err := os.WriteFile(p, want, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := mustLogin(t, s, "bob", "pw-bob")
+	if got, err := bob.LoadFile("shared.txt"); err != nil || string(got) != "HELLO world" {
+		t.Fatalf("golden content: %q %v", got, err)
+	}
+}
+
+// katVectors are published known answers for the ciphertext and chunk
+// formats, so other implementations can check themselves against ours.
+type katVectors struct {
+	Seal []struct {
+		Suite      string `json:"suite"`
+		Key        string `json:"key"`
+		Nonce      string `json:"nonce"`
+		Plaintext  string `json:"plaintext"`
+		AD         string `json:"ad"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"seal"`
+	Chunk []struct {
+		Codec      string `json:"codec"`
+		Padding    string `json:"padding"`
+		Key        string `json:"key"`
+		Nonce      string `json:"nonce"`
+		Plaintext  string `json:"plaintext"`
+		ID         string `json:"contentID"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"chunk"`
+	HKDF []struct {
+		Secret string `json:"secret"`
+		Salt   string `json:"salt"`
+		Label  string `json:"label"`
+		Length int    `json:"length"`
+		Key    string `json:"key"`
+	} `json:"hkdf"`
+	UserKeys []struct {
+		Password string `json:"password"`
+		Salt     string `json:"salt"`
+		State    string `json:"stateKey"`
+		Holder   string `json:"holderKey"`
+	} `json:"userKeys"`
+	LegacyDeriveKey []struct {
+		Password string `json:"password"`
+		Salt     string `json:"salt"`
+		Info     string `json:"info"`
+		Length   int    `json:"length"`
+		Key      string `json:"key"`
+	} `json:"legacyDeriveKey"`
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestKAT_Vectors(t *testing.T) {
+	raw, err := os.ReadFile("kat_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kat katVectors
+	if err := json.Unmarshal(raw, &kat); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range kat.Seal {
+		v := &kat.Seal[i]
+		suite, err := ParseSuite(v.Suite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, pt, ad := unhex(t, v.Key), unhex(t, v.Plaintext), unhex(t, v.AD)
+		ct, err := seal(bytes.NewReader(unhex(t, v.Nonce)), suite, key, pt, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := open(key, ct, ad, false); err != nil || !bytes.Equal(got, pt) {
+			t.Fatalf("seal %d does not open: %v", i, err)
+		}
+		if *updateGolden {
+			v.Ciphertext = hex.EncodeToString(ct)
+		} else if hex.EncodeToString(ct) != v.Ciphertext {
+			t.Errorf("seal %d (%s): got %x", i, v.Suite, ct)
+		}
+	}
+
+	for i := range kat.Chunk {
+		v := &kat.Chunk[i]
+		codec, err := ParseCodec(v.Codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode, err := ParsePadMode(v.Padding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, pt := unhex(t, v.Key), unhex(t, v.Plaintext)
+		s := &Store{rand: bytes.NewReader(unhex(t, v.Nonce))}
+		ct, err := s.sealEnvelope(key, codec, &PaddingPolicy{Mode: mode}, pt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.openChunk(key, ct); err != nil || !bytes.Equal(got, pt) {
+			t.Fatalf("chunk %d does not open: %v", i, err)
+		}
+		id := contentID(key, pt).String()
+		if *updateGolden {
+			v.Ciphertext, v.ID = hex.EncodeToString(ct), id
+		} else if hex.EncodeToString(ct) != v.Ciphertext || id != v.ID {
+			t.Errorf("chunk %d: got %x, id %s", i, ct, id)
+		}
+	}
+
+	for i := range kat.HKDF {
+		v := &kat.HKDF[i]
+		k, err := hkdfKey(unhex(t, v.Secret), unhex(t, v.Salt), string(unhex(t, v.Label)), v.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(k); got != v.Key {
+			// HKDF vectors come from RFC 5869 and are never regenerated
+			t.Errorf("hkdf %d: got %s", i, got)
+		}
+	}
+
+	for i := range kat.UserKeys {
+		v := &kat.UserKeys[i]
+		keys, err := deriveUserKeys(scheduleHKDF, v.Password, unhex(t, v.Salt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, holder := hex.EncodeToString(keys.state), hex.EncodeToString(keys.holder)
+		if *updateGolden {
+			v.State, v.Holder = state, holder
+		} else if state != v.State || holder != v.Holder {
+			t.Errorf("userKeys %d: got %s, %s", i, state, holder)
+		}
+	}
+
+	for i := range kat.LegacyDeriveKey {
+		v := &kat.LegacyDeriveKey[i]
+		got := hex.EncodeToString(legacyDeriveKey([]byte(v.Password), unhex(t, v.Salt), []byte(v.Info), v.Length))
+		if *updateGolden {
+			v.Key = got
+		} else if got != v.Key {
+			t.Errorf("legacyDeriveKey %d: got %s", i, got)
+		}
+	}
+
+	if *updateGolden {
+		b, err := json.MarshalIndent(&kat, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("kat_vectors.json", append(b, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ==========================
+// Key schedule
+// ==========================
+
+func TestKeySchedule_FileKeysAreRandom(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	c := mustLogin(t, s, "alice", "pw")
+	key := func() []byte {
+		rec, err := c.record("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Key
+	}
+	if err := c.StoreFile("f", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	first := key()
+	if err := c.Delete("f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StoreFile("f", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, key()) {
+		t.Fatalf("re-storing a name reused its file key")
+	}
+	before := key()
+	if err := c.Revoke("f"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, key()) || len(key()) != keySize {
+		t.Fatalf("revoke did not install a fresh key")
+	}
+}
+
+func TestKeySchedule_UserKeysAreDomainSeparated(t *testing.T) {
+	s := newTempStore(t)
+	if err := Signup(s, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Users["alice"].Schedule; got != scheduleWrapped {
+		t.Fatalf("new user schedule = %d", got)
+	}
+	c := mustLogin(t, s, "alice", "pw")
+	if bytes.Equal(c.masterKey, c.holderKey) {
+		t.Fatalf("state and holder keys coincide")
+	}
+	legacy := legacyDeriveKey([]byte("pw"), s.Users["alice"].Salt, []byte("master"), keySize)
+	if bytes.Equal(c.masterKey, legacy) {
+		t.Fatalf("new user got the legacy master key")
+	}
+}
+
+// legacyUser adds a user the way builds before the HKDF key schedule did.
+func legacyUser(t *testing.T, s *Store, name, password string) {
+	t.Helper()
+	salt := must(RandomBytes(16))
+	mk := legacyDeriveKey([]byte(password), salt, []byte("master"), keySize)
+	enc, err := seal(crand.Reader, SuiteAESGCM, mk, must(json.Marshal(&userPrivate{FileIndex: map[string]uuid.UUID{}})), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Users[name] = &userRecord{Username: name, Salt: salt, EncUser: enc}
+}
+
+func TestKeySchedule_LegacyUsersOnlyInMigratedStores(t *testing.T) {
+	s := newTempStore(t)
+	legacyUser(t, s, "old", "pw")
+	if _, err := Login(s, "old", "pw"); !errors.Is(err, errLegacySchedule) {
+		t.Fatalf("legacy user in new store: %v", err)
+	}
+
+	s.LegacyKeySchedule = true
+	c := mustLogin(t, s, "old", "pw")
+	if !bytes.Equal(c.masterKey, c.holderKey) {
+		t.Fatalf("legacy user should keep one master key")
+	}
+	if err := c.StoreFile("f", []byte("still works")); err != nil {
+		t.Fatal(err)
+	}
+	c = mustLogin(t, s, "old", "pw")
+	if got, err := c.LoadFile("f"); err != nil || string(got) != "still works" {
+		t.Fatalf("legacy user round trip: %q %v", got, err)
+	}
+	if _, err := Login(s, "old", "wrong"); err == nil {
+		t.Fatalf("legacy login accepted a wrong password")
+	}
+
+	// The first login rewrapped the same keys, so the flag is no longer
+	// needed for this user.
+	if s.Users["old"].Schedule != scheduleWrapped {
+		t.Fatalf("legacy user not upgraded on login")
+	}
+	s.LegacyKeySchedule = false
+	if again := mustLogin(t, s, "old", "pw"); !bytes.Equal(again.masterKey, c.masterKey) {
+		t.Fatalf("upgrade changed the user's keys")
+	}
+}
+
+// ==========================
+// Account recovery
+// ==========================
+
+func TestRecovery_CodeResetsPasswordOnce(t *testing.T) {
+	s := newTempStore(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	if err := alice.StoreFile("diary", []byte("dear diary")); err != nil {
+		t.Fatal(err)
+	}
+	code, err := alice.CreateShare("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mustLogin(t, s, "bob", "pw").AcceptShare("d", code); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := alice.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || alice.RecoveryCodesLeft() != recoveryCodeCount {
+		t.Fatalf("got %d codes, %d left", len(codes), alice.RecoveryCodesLeft())
+	}
+
+	// Codes are accepted in any case and without dashes.
+	typed := strings.ToLower(strings.ReplaceAll(codes[3], "-", " "))
+	c, err := Recover(s, "alice", typed, "new-pw")
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if got, err := c.LoadFile("diary"); err != nil || string(got) != "dear diary" {
+		t.Fatalf("files after recovery: %q %v", got, err)
+	}
+	if _, err := Login(s, "alice", "pw"); err == nil {
+		t.Fatalf("old password still works")
+	}
+	mustLogin(t, s, "alice", "new-pw")
+	if c.RecoveryCodesLeft() != recoveryCodeCount-1 {
+		t.Fatalf("code not consumed: %d left", c.RecoveryCodesLeft())
+	}
+	if _, err := Recover(s, "alice", codes[3], "again"); !errors.Is(err, ErrBadRecoveryCode) {
+		t.Fatalf("reused code: %v", err)
+	}
+	if _, err := Recover(s, "bob", codes[4], "stolen"); !errors.Is(err, ErrBadRecoveryCode) {
+		t.Fatalf("alice's code recovered bob: %v", err)
+	}
+
+	// Holder tags survive, so the shared file is still reachable and
+	// nothing is collected.
+	if files, chunks := s.unreachable(); len(files)+len(chunks) != 0 {
+		t.Fatalf("recovery orphaned %d files, %d chunks", len(files), len(chunks))
+	}
+
+	// A new batch replaces the old one.
+	if _, err := c.GenerateRecoveryCodes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Recover(s, "alice", codes[5], "x"); !errors.Is(err, ErrBadRecoveryCode) {
+		t.Fatalf("code from an old batch: %v", err)
+	}
+}
+
+func TestRecovery_SurvivesReopen(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := mustLogin(t, s, "alice", "pw").GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Recover(s, "alice", codes[0], "new"); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustLogin(t, s, "alice", "new")
+}
+
+// ==========================
+// Shamir sharing & trustee escrow
+// ==========================
+
+func TestShamir_GF256(t *testing.T) {
+	// 0x53 * 0xca = 0x01 in the AES field (FIPS-197 §4.2)
+	if gf256Mul(0x53, 0xca) != 0x01 || gf256Inv(0x53) != 0xca {
+		t.Fatalf("GF(256) arithmetic is off")
+	}
+	for a := 1; a < 256; a++ {
+		if gf256Mul(byte(a), gf256Inv(byte(a))) != 1 {
+			t.Fatalf("no inverse for %#x", a)
+		}
+	}
+}
+
+func TestShamir_AnyThresholdSubsetRecovers(t *testing.T) {
+	secret := must(RandomBytes(64))
+	shares, err := splitSecret(crand.Reader, secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mask := 0; mask < 1<<5; mask++ {
+		var subset []share
+		for i := range shares {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, shares[i])
+			}
+		}
+		if len(subset) == 0 {
+			continue
+		}
+		got, err := combineShares(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := bytes.Equal(got, secret); ok != (len(subset) >= 3) {
+			t.Fatalf("%d shares (mask %05b): recovered=%v", len(subset), mask, ok)
+		}
+	}
+
+	if _, err := combineShares([]share{shares[0], shares[0]}); err == nil {
+		t.Fatalf("duplicate shares accepted")
+	}
+	for _, nk := range [][2]int{{3, 0}, {3, 4}, {256, 2}} {
+		if _, err := splitSecret(crand.Reader, secret, nk[0], nk[1]); err == nil {
+			t.Fatalf("split %d/%d accepted", nk[1], nk[0])
+		}
+	}
+}
+
+func TestShamir_BelowThresholdRevealsNothing(t *testing.T) {
+	// With k=2, one share's byte is uniform whatever the secret: over all
+	// 256 choices of the random coefficient each value appears once.
+	for _, secret := range []byte{0x00, 0x5a} {
+		seen := map[byte]bool{}
+		for c := 0; c < 256; c++ {
+			seen[gf256Eval([]byte{secret, byte(c)}, 7)] = true
+		}
+		if len(seen) != 256 {
+			t.Fatalf("share of %#x not uniform: %d values", secret, len(seen))
+		}
+	}
+}
+
+func TestSealedBox_OnlyRecipientOpens(t *testing.T) {
+	s := newTempStore(t)
+	bob, eve := must(newKeyPair(crand.Reader)), must(newKeyPair(crand.Reader))
+	box, err := s.sealTo(bob.PublicKey().Bytes(), []byte("for bob"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := openFrom(bob, box, []byte("ad")); err != nil || string(pt) != "for bob" {
+		t.Fatalf("recipient: %q %v", pt, err)
+	}
+	if _, err := openFrom(eve, box, []byte("ad")); err == nil {
+		t.Fatalf("someone else opened the box")
+	}
+	if _, err := openFrom(bob, box, []byte("other")); err == nil {
+		t.Fatalf("box opened under different associated data")
+	}
+}
+
+// escrowTeam signs up alice and three trustees, stores a file for alice
+// and escrows her keys 2-of-3.
+func escrowTeam(t *testing.T) (*Store, map[string]*Client) {
+	t.Helper()
+	s := newTempStore(t)
+	cs := map[string]*Client{}
+	for _, u := range []string{"alice", "bob", "carol", "dave"} {
+		if err := Signup(s, u, "pw-"+u); err != nil {
+			t.Fatal(err)
+		}
+		cs[u] = mustLogin(t, s, u, "pw-"+u)
+	}
+	if err := cs["alice"].StoreFile("plans", []byte("world domination")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs["alice"].SetupEscrow([]string{"bob", "carol", "dave"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	return s, cs
+}
+
+func TestEscrow_TwoOfThreeTrusteesRestoreAccess(t *testing.T) {
+	s, cs := escrowTeam(t)
+	if ts, k := cs["alice"].Trustees(); len(ts) != 3 || k != 2 {
+		t.Fatalf("trustees %v, threshold %d", ts, k)
+	}
+
+	req, err := RequestEscrowRecovery(s, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := cs["bob"].PendingEscrowRequests()
+	if len(pending) != 1 || pending[0].User != "alice" || pending[0].Fingerprint != req.Fingerprint {
+		t.Fatalf("bob sees %+v", pending)
+	}
+	if len(cs["alice"].PendingEscrowRequests()) != 0 {
+		t.Fatalf("non-trustee sees the request")
+	}
+
+	if err := cs["bob"].ApproveEscrowRecovery("alice", req.Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompleteEscrowRecovery(s, req, "new-pw"); !errors.Is(err, ErrNotEnoughApprovals) {
+		t.Fatalf("one approval: %v", err)
+	}
+	// Fingerprints are compared like recovery codes.
+	if err := cs["dave"].ApproveEscrowRecovery("alice", strings.ToLower(req.Fingerprint)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := CompleteEscrowRecovery(s, req, "new-pw")
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if got, err := c.LoadFile("plans"); err != nil || string(got) != "world domination" {
+		t.Fatalf("files after escrow recovery: %q %v", got, err)
+	}
+	if _, err := Login(s, "alice", "pw-alice"); err == nil {
+		t.Fatalf("old password still works")
+	}
+	if s.Users["alice"].Escrow.Request != nil {
+		t.Fatalf("request not cleared")
+	}
+
+	// The shares survive, so the same trustees can help again.
+	req, err = RequestEscrowRecovery(s, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"carol", "dave"} {
+		if err := cs[u].ApproveEscrowRecovery("alice", req.Fingerprint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := CompleteEscrowRecovery(s, req, "newer-pw"); err != nil {
+		t.Fatal(err)
+	}
+	mustLogin(t, s, "alice", "newer-pw")
+}
+
+func TestEscrow_ApprovalGuards(t *testing.T) {
+	s, cs := escrowTeam(t)
+	if err := cs["bob"].ApproveEscrowRecovery("alice", "whatever"); !errors.Is(err, ErrNoEscrowRequest) {
+		t.Fatalf("approve with no request: %v", err)
+	}
+	req, err := RequestEscrowRecovery(s, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs["bob"].ApproveEscrowRecovery("alice", "0000-0000-0000-0000"); !errors.Is(err, ErrFingerprint) {
+		t.Fatalf("wrong fingerprint: %v", err)
+	}
+	if err := cs["alice"].ApproveEscrowRecovery("alice", req.Fingerprint); !errors.Is(err, ErrNotTrustee) {
+		t.Fatalf("self approval: %v", err)
+	}
+
+	// Someone who swaps in a request of their own is approved only by
+	// trustees who skip the fingerprint check, and the real requester's
+	// key no longer matches.
+	mallory, err := RequestEscrowRecovery(s, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs["bob"].ApproveEscrowRecovery("alice", req.Fingerprint); !errors.Is(err, ErrFingerprint) {
+		t.Fatalf("approved a swapped request: %v", err)
+	}
+	if _, err := CompleteEscrowRecovery(s, req, "x"); !errors.Is(err, ErrNoEscrowRequest) {
+		t.Fatalf("stale request: %v", err)
+	}
+
+	// A single trustee's share opens nothing, even for the requester.
+	if err := cs["carol"].ApproveEscrowRecovery("alice", mallory.Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompleteEscrowRecovery(s, mallory, "x"); !errors.Is(err, ErrNotEnoughApprovals) {
+		t.Fatalf("below threshold: %v", err)
+	}
+
+	if err := cs["alice"].SetupEscrow([]string{"bob", "bob"}, 1); err == nil {
+		t.Fatalf("duplicate trustee accepted")
+	}
+	if err := cs["alice"].SetupEscrow([]string{"bob", "nobody"}, 1); err == nil {
+		t.Fatalf("unknown trustee accepted")
+	}
+	if err := cs["alice"].SetupEscrow([]string{"bob"}, 2); err == nil {
+		t.Fatalf("threshold above trustee count accepted")
+	}
+	if err := cs["alice"].DisableEscrow(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RequestEscrowRecovery(s, "alice"); !errors.Is(err, ErrNoEscrow) {
+		t.Fatalf("request without escrow: %v", err)
+	}
+}
+
+func TestEscrow_ADsSeparateNames(t *testing.T) {
+	for _, ad := range []func(user, trustee string) []byte{escrowShareAD, escrowApprovalAD} {
+		if bytes.Equal(ad("a|b", "c"), ad("a", "b|c")) {
+			t.Fatalf("escrow ADs collide across the name boundary")
+		}
+	}
+	if bytes.Equal(escrowShareAD("a", "b"), escrowApprovalAD("a", "b")) {
+		t.Fatalf("share and approval ADs collide")
+	}
+}
+
+func TestEscrow_OldUsersGetKeyPairOnLogin(t *testing.T) {
+	s := newTempStore(t)
+	s.LegacyKeySchedule = true
+	legacyUser(t, s, "old", "pw")
+	if s.Users["old"].PublicKey != nil {
+		t.Fatal("legacy user already has a key pair")
+	}
+	c := mustLogin(t, s, "old", "pw")
+	if s.Users["old"].PublicKey == nil || c.priv.PrivateKey == nil {
+		t.Fatal("no key pair after login")
+	}
+	priv, err := c.privateKey()
+	if err != nil || !bytes.Equal(priv.PublicKey().Bytes(), s.Users["old"].PublicKey) {
+		t.Fatalf("key pair halves do not match: %v", err)
+	}
+	if again := mustLogin(t, s, "old", "pw"); !bytes.Equal(again.priv.PrivateKey, c.priv.PrivateKey) {
+		t.Fatal("key pair replaced on second login")
+	}
+}
+
+// ==========================
+// Organization escrow
+// ==========================
+
+func TestOrgEscrow_AuditorDecryptsNewFiles(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	if err := alice.StoreFile("before", []byte("pre-policy")); err != nil {
+		t.Fatal(err)
+	}
+
+	priv, pub, err := GenerateOrgEscrowKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOrgEscrow(pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.StoreFile("ledger", []byte("q3 numbers")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AppendFile("ledger", []byte(", q4 numbers")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := alice.Stat("ledger"); !fi.Escrowed {
+		t.Fatalf("new file not marked escrowed")
+	}
+	if fi, _ := alice.Stat("before"); fi.Escrowed {
+		t.Fatalf("policy reached back to an older file")
+	}
+
+	// The auditor works from the store file and the private key alone.
+	audit, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audit.OrgEscrow == nil || audit.OrgEscrow.Fingerprint() != Fingerprint(pub) {
+		t.Fatalf("policy not visible after reopen: %+v", audit.OrgEscrow)
+	}
+	files, err := OrgEscrowFiles(audit, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Owner != "alice" || files[0].Name != "ledger" {
+		t.Fatalf("escrowed files: %+v", files)
+	}
+	got, err := OrgEscrowDecrypt(audit, priv, files[0].Root)
+	if err != nil || string(got) != "q3 numbers, q4 numbers" {
+		t.Fatalf("auditor read %q, %v", got, err)
+	}
+
+	// Someone else's key opens nothing.
+	other, _, err := GenerateOrgEscrowKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OrgEscrowDecrypt(audit, other, files[0].Root); !errors.Is(err, ErrNotEscrowed) {
+		t.Fatalf("wrong escrow key: %v", err)
+	}
+	if fs, _ := OrgEscrowFiles(audit, other); len(fs) != 0 {
+		t.Fatalf("wrong escrow key lists %d files", len(fs))
+	}
+
+	// Escrow boxes are bound to their file.
+	before := audit.Files[alice.priv.FileIndex["before"]]
+	before.Escrow = audit.Files[files[0].Root].Escrow
+	if _, err := OrgEscrowDecrypt(audit, priv, alice.priv.FileIndex["before"]); !errors.Is(err, ErrNotEscrowed) {
+		t.Fatalf("moved escrow box opened: %v", err)
+	}
+}
+
+func TestOrgEscrow_FollowsKeyRotationAndSnapshots(t *testing.T) {
+	s := newTempStore(t)
+	priv, pub, err := GenerateOrgEscrowKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOrgEscrow(pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := Signup(s, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	if err := alice.StoreFile("f", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	root := alice.priv.FileIndex["f"]
+	if err := alice.Snapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Revoke("f"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := OrgEscrowDecrypt(s, priv, root); err != nil || string(got) != "v1" {
+		t.Fatalf("after revoke: %q %v", got, err)
+	}
+
+	// A record recreated from a snapshot keeps its escrow.
+	if err := alice.Delete("f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Files[root]; ok {
+		t.Fatalf("deleted record survived GC")
+	}
+	if err := alice.RestoreSnapshotFile("s", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := OrgEscrowDecrypt(s, priv, root); err != nil || string(got) != "v1" {
+		t.Fatalf("after restore: %q %v", got, err)
+	}
+
+	// Once the policy is cleared, rotation takes the file out of escrow.
+	if err := s.ClearOrgEscrow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Revoke("f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OrgEscrowDecrypt(s, priv, root); !errors.Is(err, ErrNotEscrowed) {
+		t.Fatalf("rotated key still escrowed: %v", err)
+	}
+}
+
+// ==========================
+// Groups
+// ==========================
+
+// groupTeam signs up alice (the owner) and members, and creates the group
+// eng with all of them.
+func groupTeam(t *testing.T, members ...string) (*Store, map[string]*Client) {
+	t.Helper()
+	s := newTempStore(t)
+	cs := map[string]*Client{}
+	for _, u := range append([]string{"alice", "mallory"}, members...) {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+		cs[u] = mustLogin(t, s, u, "pw")
+	}
+	if err := cs["alice"].CreateGroup("eng", members); err != nil {
+		t.Fatal(err)
+	}
+	return s, cs
+}
+
+func TestGroups_OneShareReachesEveryMember(t *testing.T) {
+	members := []string{"bob", "carol", "dave", "erin", "frank"}
+	s, cs := groupTeam(t, members...)
+	alice := cs["alice"]
+	if err := alice.StoreFile("spec", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("spec", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range members {
+		c := mustLogin(t, s, u, "pw")
+		if got, err := c.LoadFile("group:eng/spec"); err != nil || string(got) != "v1" {
+			t.Fatalf("%s: %q %v", u, got, err)
+		}
+	}
+	if _, err := mustLogin(t, s, "mallory", "pw").LoadFile("group:eng/spec"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("non-member got the file: %v", err)
+	}
+
+	// Members share the record, so they see later writes.
+	if err := alice.AppendFile("spec", []byte(", v2")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mustLogin(t, s, "bob", "pw").LoadFile("group:eng/spec"); string(got) != "v1, v2" {
+		t.Fatalf("bob sees %q", got)
+	}
+	gs := alice.Groups()
+	if len(gs) != 1 || len(gs[0].Members) != 6 || gs[0].Files != 1 {
+		t.Fatalf("groups: %+v", gs)
+	}
+
+	// Any member can share into the group.
+	bob := mustLogin(t, s, "bob", "pw")
+	if err := bob.StoreFile("notes", []byte("from bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.ShareWith("notes", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := alice.SyncGroups(); err != nil || !changed {
+		t.Fatalf("sync: %v %v", changed, err)
+	}
+	if got, err := alice.LoadFile("group:eng/notes"); err != nil || string(got) != "from bob" {
+		t.Fatalf("alice: %q %v", got, err)
+	}
+}
+
+func TestGroups_RemovedMemberMissesLaterShares(t *testing.T) {
+	s, cs := groupTeam(t, "bob", "carol")
+	alice := cs["alice"]
+	if err := alice.StoreFile("old", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("old", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	carol := mustLogin(t, s, "carol", "pw")
+	oldKey, err := carol.groupKey("eng", s.Groups["eng"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.RemoveGroupMember("eng", "carol", false); err != nil {
+		t.Fatal(err)
+	}
+	if s.Groups["eng"].Epoch != 2 || bytes.Equal(s.Groups["eng"].PublicKey, oldKey.PublicKey().Bytes()) {
+		t.Fatalf("group key not rotated")
+	}
+	if err := alice.StoreFile("new", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("new", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol's last copy of the group key opens none of the shares now.
+	for root, sh := range s.Groups["eng"].Shares {
+		if _, err := openFrom(oldKey, sh.Box, groupShareAD("eng", root)); err == nil {
+			t.Fatalf("old group key opens %s", sh.Name)
+		}
+	}
+	carol = mustLogin(t, s, "carol", "pw")
+	if _, err := carol.LoadFile("group:eng/new"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("removed member got a later share: %v", err)
+	}
+	if got, err := carol.LoadFile("group:eng/old"); err != nil || string(got) != "before" {
+		t.Fatalf("without revokePrior carol keeps earlier files: %q %v", got, err)
+	}
+	bob := mustLogin(t, s, "bob", "pw")
+	for name, want := range map[string]string{"old": "before", "new": "after"} {
+		if got, err := bob.LoadFile("group:eng/" + name); err != nil || string(got) != want {
+			t.Fatalf("bob %s: %q %v", name, got, err)
+		}
+	}
+}
+
+func TestGroups_RevokePriorRekeysEarlierShares(t *testing.T) {
+	s, cs := groupTeam(t, "bob", "carol")
+	alice := cs["alice"]
+	if err := alice.StoreFile("old", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("old", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	carol := mustLogin(t, s, "carol", "pw")
+	if _, err := carol.LoadFile("group:eng/old"); err != nil {
+		t.Fatal(err)
+	}
+	root := alice.priv.FileIndex["old"]
+	before := copyBytes(s.Files[root].Key)
+
+	if err := alice.RemoveGroupMember("eng", "carol", true); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, s.Files[root].Key) {
+		t.Fatalf("earlier share not re-keyed")
+	}
+	carol = mustLogin(t, s, "carol", "pw")
+	if _, err := carol.LoadFile("group:eng/old"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("revoked member kept an earlier file: %v", err)
+	}
+	if got, err := mustLogin(t, s, "bob", "pw").LoadFile("group:eng/old"); err != nil || string(got) != "before" {
+		t.Fatalf("bob after re-key: %q %v", got, err)
+	}
+
+	// Re-adding restores access.
+	if err := alice.AddGroupMember("eng", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mustLogin(t, s, "carol", "pw").LoadFile("group:eng/old"); err != nil || string(got) != "before" {
+		t.Fatalf("re-added carol: %q %v", got, err)
+	}
+}
+
+func TestGroups_FailedRevokePriorChangesNothing(t *testing.T) {
+	s, cs := groupTeam(t, "bob", "carol")
+	alice := cs["alice"]
+	for _, name := range []string{"a", "b"} {
+		if err := alice.StoreFile(name, []byte("content of "+name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := alice.ShareWith(name, "group:eng"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Break the file re-keyed last, so the first has already been
+	// re-encrypted when the second fails.
+	roots := sortedKeys(s.Groups["eng"].Shares)
+	first, last := s.Files[roots[0]], s.Files[roots[1]]
+	ct := s.Chunks[last.Chunks[0]]
+	ct[len(ct)-1] ^= 0x01
+	key, chunks, epoch := copyBytes(first.Key), len(s.Chunks), s.Groups["eng"].Epoch
+
+	if err := alice.RemoveGroupMember("eng", "carol", true); err == nil {
+		t.Fatalf("re-key of a corrupt file succeeded")
+	}
+	if !bytes.Equal(first.Key, key) || len(s.Chunks) != chunks {
+		t.Fatalf("failed removal re-keyed the first file")
+	}
+	if g := s.Groups["eng"]; g.Epoch != epoch || g.Members["carol"] == nil || g.Revoked["carol"] {
+		t.Fatalf("failed removal changed the group")
+	}
+	name := s.Groups["eng"].Shares[roots[0]].Name
+	for _, u := range []string{"bob", "carol"} {
+		if got, err := mustLogin(t, s, u, "pw").LoadFile("group:eng/" + name); err != nil || string(got) != "content of "+name {
+			t.Fatalf("%s after failed removal: %q %v", u, got, err)
+		}
+	}
+}
+
+func TestGroups_FailedNoticeChangesNothing(t *testing.T) {
+	s, cs := groupTeam(t, "bob", "carol")
+	alice := cs["alice"]
+	if err := alice.StoreFile("a", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("a", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	// Carol's revocation notice cannot be sealed, so the removal must
+	// fail before rotating the group or re-keying the file.
+	rec := s.Users["carol"]
+	pub := rec.PublicKey
+	rec.PublicKey = []byte{1}
+	root := sortedKeys(s.Groups["eng"].Shares)[0]
+	key, epoch := copyBytes(s.Files[root].Key), s.Groups["eng"].Epoch
+	if err := alice.RemoveGroupMember("eng", "carol", true); err == nil {
+		t.Fatalf("removal with an unsealable notice succeeded")
+	}
+	if g := s.Groups["eng"]; g.Epoch != epoch || g.Members["carol"] == nil || g.Revoked["carol"] {
+		t.Fatalf("failed removal changed the group")
+	}
+	if !bytes.Equal(s.Files[root].Key, key) {
+		t.Fatalf("failed removal re-keyed the file")
+	}
+	rec.PublicKey = pub
+	if got, err := mustLogin(t, s, "carol", "pw").LoadFile("group:eng/a"); err != nil || string(got) != "v1" {
+		t.Fatalf("carol after failed removal: %q %v", got, err)
+	}
+}
+
+func TestGroups_Guards(t *testing.T) {
+	s, cs := groupTeam(t, "bob")
+	alice, bob, mallory := cs["alice"], cs["bob"], cs["mallory"]
+	if err := alice.StoreFile("f", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("f", "eng"); !errors.Is(err, ErrShareTarget) {
+		t.Fatalf("bare target: %v", err)
+	}
+	if err := alice.ShareWith("f", "group:ops"); !errors.Is(err, ErrNoGroup) {
+		t.Fatalf("unknown group: %v", err)
+	}
+	if err := mallory.StoreFile("m", []byte("spam")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mallory.ShareWith("m", "group:eng"); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("non-member share: %v", err)
+	}
+	if err := bob.AddGroupMember("eng", "mallory"); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("non-owner add: %v", err)
+	}
+	if err := alice.RemoveGroupMember("eng", "alice", false); err == nil {
+		t.Fatalf("owner removed themselves")
+	}
+	if err := alice.CreateGroup("eng", nil); err == nil {
+		t.Fatalf("duplicate group")
+	}
+	if err := alice.CreateGroup("a/b", nil); err == nil {
+		t.Fatalf("group name with a slash")
+	}
+	if err := alice.CreateGroup("ops", []string{"nobody"}); err == nil {
+		t.Fatalf("unknown member accepted")
+	}
+	if _, ok := s.Groups["ops"]; ok {
+		t.Fatalf("failed create left a group behind")
+	}
+
+	// A share box moved to another file does not bind it.
+	if err := alice.ShareWith("f", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	g := s.Groups["eng"]
+	mroot := mallory.priv.FileIndex["m"]
+	g.Shares[mroot] = &groupShare{Name: "m", From: "alice", Box: g.Shares[alice.priv.FileIndex["f"]].Box}
+	if _, err := mustLogin(t, s, "bob", "pw").LoadFile("group:eng/m"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("forged share bound: %v", err)
+	}
+
+	// A name whose record is gone is not found rather than a panic.
+	delete(s.Files, mroot)
+	if err := mallory.ShareWith("m", "group:eng"); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("non-member share: %v", err)
+	}
+	if err := alice.StoreFile("gone", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	delete(s.Files, alice.priv.FileIndex["gone"])
+	if err := alice.ShareWith("gone", "group:eng"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("share of a missing record: %v", err)
+	}
+}
+
+// ==========================
+// Inbox
+// ==========================
+
+func TestInbox_DirectShareArrivesAndIsAccepted(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	s, err := OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"alice", "bob"} {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	if err := alice.StoreFile("report", []byte("q3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("report", "user:bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("report", "user:nobody"); err == nil {
+		t.Fatalf("shared with an unknown user")
+	}
+
+	s, err = OpenStore(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := mustLogin(t, s, "alice", "pw").Unread(); n != 0 {
+		t.Fatalf("alice has %d unread", n)
+	}
+	bob := mustLogin(t, s, "bob", "pw")
+	if n := bob.Unread(); n != 1 {
+		t.Fatalf("login reported %d unread, want 1", n)
+	}
+	msgs, err := bob.Inbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Kind != InboxShareReceived || msgs[0].From != "alice" || msgs[0].Name != "report" || msgs[0].Code == "" {
+		t.Fatalf("bob's inbox: %+v", msgs)
+	}
+	if err := bob.AcceptFromInbox(msgs[0].ID, "alice-report"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bob.LoadFile("alice-report"); err != nil || string(got) != "q3" {
+		t.Fatalf("accepted share: %q %v", got, err)
+	}
+	if msgs, _ := bob.Inbox(); len(msgs) != 0 || bob.Unread() != 0 {
+		t.Fatalf("accepted message not dismissed: %+v, %d unread", msgs, bob.Unread())
+	}
+	if err := bob.Dismiss(msgs[0].ID); !errors.Is(err, ErrNoMessage) {
+		t.Fatalf("dismiss twice: %v", err)
+	}
+
+	// The sharer deleting the file is news for bob, whose copy stays.
+	alice = mustLogin(t, s, "alice", "pw")
+	if err := alice.Delete("report"); err != nil {
+		t.Fatal(err)
+	}
+	bob = mustLogin(t, s, "bob", "pw")
+	msgs, _ = bob.Inbox()
+	if len(msgs) != 1 || msgs[0].Kind != InboxFileDeleted || msgs[0].Name != "report" {
+		t.Fatalf("after delete: %+v", msgs)
+	}
+	if _, err := bob.LoadFile("alice-report"); err != nil {
+		t.Fatalf("bob lost his copy: %v", err)
+	}
+	if err := bob.Dismiss(msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ := mustLogin(t, s, "bob", "pw").Inbox(); len(msgs) != 0 {
+		t.Fatalf("dismissal not persisted: %+v", msgs)
+	}
+}
+
+func TestInbox_GroupEvents(t *testing.T) {
+	s, cs := groupTeam(t, "bob", "carol")
+	alice := cs["alice"]
+	if err := alice.StoreFile("plan", []byte("ship it")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("plan", "group:eng"); err != nil {
+		t.Fatal(err)
+	}
+	kinds := func(u string) []InboxKind {
+		msgs, err := mustLogin(t, s, u, "pw").Inbox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []InboxKind
+		for _, m := range msgs {
+			if m.Group != "eng" {
+				t.Fatalf("%s: message without group: %+v", u, m)
+			}
+			out = append(out, m.Kind)
+		}
+		return out
+	}
+	if got := kinds("alice"); len(got) != 0 {
+		t.Fatalf("sharer notified of own share: %v", got)
+	}
+	if got := kinds("bob"); len(got) != 1 || got[0] != InboxShareReceived {
+		t.Fatalf("bob: %v", got)
+	}
+
+	if err := alice.RemoveGroupMember("eng", "carol", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := kinds("carol"); len(got) != 2 || got[1] != InboxAccessRevoked {
+		t.Fatalf("carol: %v", got)
+	}
+
+	// Deleting withdraws the file from the group: members who have it
+	// keep it, later members never see it.
+	if err := alice.Delete("plan"); err != nil {
+		t.Fatal(err)
+	}
+	if got := kinds("bob"); len(got) != 2 || got[1] != InboxFileDeleted {
+		t.Fatalf("bob after delete: %v", got)
+	}
+	if err := alice.AddGroupMember("eng", "mallory"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mustLogin(t, s, "mallory", "pw").LoadFile("group:eng/plan"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("withdrawn file reached a new member: %v", err)
+	}
+}
+
+func TestInbox_MessagesAreSealedToTheRecipient(t *testing.T) {
+	s := newTempStore(t)
+	for _, u := range []string{"alice", "bob", "mallory"} {
+		if err := Signup(s, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := mustLogin(t, s, "alice", "pw")
+	if err := alice.StoreFile("f", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ShareWith("f", "user:bob"); err != nil {
+		t.Fatal(err)
+	}
+	entry := s.Users["bob"].Inbox[0]
+	mallory := mustLogin(t, s, "mallory", "pw")
+	priv, err := mallory.privateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFrom(priv, entry.Box, inboxAD("bob")); err == nil {
+		t.Fatalf("mallory opened bob's message")
+	}
+	// Copying it into her own inbox does not help either.
+	s.Users["mallory"].Inbox = append(s.Users["mallory"].Inbox, entry)
+	if msgs, err := mallory.Inbox(); err != nil || len(msgs) != 0 {
+		t.Fatalf("mallory reads %+v, %v", msgs, err)
+	}
+}
@@ -0,0 +1,108 @@
+package securefs
+
+import (
+	"errors"
+	"io"
+)
+
+// Shamir secret sharing over GF(2^8), byte by byte: each secret byte is
+// the constant term of a random polynomial of degree k-1, and share i is
+// the polynomials evaluated at x = i. Any k shares determine the
+// polynomials by Lagrange interpolation; k-1 shares are consistent with
+// every possible secret, so reveal nothing about it.
+
+var (
+	errShareCount = errors.New("need 1 <= threshold <= shares <= 255")
+	errShares     = errors.New("shares are inconsistent")
+)
+
+// share is one point on each of the secret's polynomials.
+type share struct {
+	X byte
+	Y []byte
+}
+
+// splitSecret splits secret into n shares, any k of which recover it.
+func splitSecret(rnd io.Reader, secret []byte, n, k int) ([]share, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, errShareCount
+	}
+	shares := make([]share, n)
+	for i := range shares {
+		shares[i] = share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, k)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := io.ReadFull(rnd, coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i].Y[b] = gf256Eval(coeffs, shares[i].X)
+		}
+	}
+	return shares, nil
+}
+
+// combineShares interpolates shares at x = 0. Given fewer shares than
+// the threshold it returns a wrong secret, not an error; callers check
+// the result.
+func combineShares(shares []share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errShares
+	}
+	n := len(shares[0].Y)
+	seen := map[byte]bool{}
+	for _, s := range shares {
+		if s.X == 0 || seen[s.X] || len(s.Y) != n {
+			return nil, errShares
+		}
+		seen[s.X] = true
+	}
+	secret := make([]byte, n)
+	for i, si := range shares {
+		// Lagrange basis polynomial for si at 0: prod x_j / (x_j - x_i)
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = gf256Mul(l, gf256Mul(sj.X, gf256Inv(sj.X^si.X)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gf256Mul(si.Y[b], l)
+		}
+	}
+	return secret, nil
+}
+
+// gf256Eval evaluates the polynomial with coefficients c (constant term
+// first) at x, by Horner's rule.
+func gf256Eval(c []byte, x byte) byte {
+	var y byte
+	for i := len(c) - 1; i >= 0; i-- {
+		y = gf256Mul(y, x) ^ c[i]
+	}
+	return y
+}
+
+// gf256Mul multiplies in GF(2^8) modulo x^8+x^4+x^3+x+1 (the AES field),
+// without table lookups or branches on secret data.
+func gf256Mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gf256Inv returns a^254, which is a's inverse for a != 0 (and 0 for 0).
+func gf256Inv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gf256Mul(r, r)
+		r = gf256Mul(r, a)
+	}
+	return gf256Mul(r, r)
+}
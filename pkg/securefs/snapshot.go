@@ -0,0 +1,231 @@
+package securefs
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoSnapshot = errors.New("no such snapshot")
+
+// Snapshot freezes the caller's whole namespace under label. Nothing is
+// copied: the snapshot pins the current chunk list of every file, and
+// later writes leave pinned chunks in place until the snapshot is deleted.
+func (c *Client) Snapshot(label string) error {
+	if label == "" {
+		return errors.New("empty snapshot label")
+	}
+	if _, ok := c.priv.Snapshots[label]; ok {
+		return errors.New("snapshot exists")
+	}
+	now := c.store.now()
+	id := c.store.newID()
+	snap := &snapshotRecord{Time: now, Files: map[uuid.UUID]*frozenFile{}}
+	idx := &snapshotIndex{ID: id, Time: now, Files: map[string]uuid.UUID{}}
+	for name, root := range c.priv.FileIndex {
+		rec, ok := c.store.Files[root]
+		if !ok {
+			continue
+		}
+		idx.Files[name] = root
+		if _, ok := snap.Files[root]; !ok {
+			snap.Files[root] = rec.freeze()
+			c.store.ref(rec.Chunks)
+		}
+	}
+	c.store.Snapshots[id] = snap
+	if c.priv.Snapshots == nil {
+		c.priv.Snapshots = map[string]*snapshotIndex{}
+	}
+	c.priv.Snapshots[label] = idx
+	return c.persist()
+}
+
+// ListSnapshots returns the caller's snapshots, oldest first.
+func (c *Client) ListSnapshots() []SnapshotInfo {
+	out := make([]SnapshotInfo, 0, len(c.priv.Snapshots))
+	for label, idx := range c.priv.Snapshots {
+		out = append(out, SnapshotInfo{Label: label, Time: idx.Time, Files: len(idx.Files)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Time.Equal(out[j].Time) {
+			return out[i].Time.Before(out[j].Time)
+		}
+		return out[i].Label < out[j].Label
+	})
+	return out
+}
+
+// SnapshotFiles lists the filenames captured by the named snapshot.
+func (c *Client) SnapshotFiles(label string) ([]string, error) {
+	idx, ok := c.priv.Snapshots[label]
+	if !ok { return nil, ErrNoSnapshot }
+	names := make([]string, 0, len(idx.Files))
+	for name := range idx.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadSnapshotFile returns the content name had when label was taken.
+func (c *Client) LoadSnapshotFile(label, name string) ([]byte, error) {
+	_, f, err := c.frozen(label, name)
+	if err != nil { return nil, err }
+	return c.store.readChunks(f.record(), 0, len(f.Chunks))
+}
+
+// RestoreSnapshotFile puts name back to its state in the named snapshot,
+// rebinding it if it has since been deleted. The file keeps its root, so
+// shares of it see the restored content.
+func (c *Client) RestoreSnapshotFile(label, name string) error {
+	root, f, err := c.frozen(label, name)
+	if err != nil { return err }
+	if err := c.store.thaw(root, f); err != nil { return err }
+	c.bind(name, root)
+	return c.persist()
+}
+
+// RestoreSnapshot restores every file captured by the named snapshot.
+// Files created after the snapshot are left alone.
+func (c *Client) RestoreSnapshot(label string) error {
+	idx, ok := c.priv.Snapshots[label]
+	if !ok { return ErrNoSnapshot }
+	snap, ok := c.store.Snapshots[idx.ID]
+	if !ok { return ErrNoSnapshot }
+	for name, root := range idx.Files {
+		if err := c.store.thaw(root, snap.Files[root]); err != nil { return err }
+		c.bind(name, root)
+	}
+	return c.persist()
+}
+
+// DeleteSnapshot drops the named snapshot and any chunks only it pinned.
+func (c *Client) DeleteSnapshot(label string) error {
+	idx, ok := c.priv.Snapshots[label]
+	if !ok { return ErrNoSnapshot }
+	delete(c.priv.Snapshots, label)
+	if snap, ok := c.store.Snapshots[idx.ID]; ok {
+		delete(c.store.Snapshots, idx.ID)
+		for _, f := range snap.Files {
+			c.store.dropChunks(f.Chunks)
+		}
+	}
+	return c.persist()
+}
+
+// frozen looks up name's root and pinned state in the named snapshot.
+func (c *Client) frozen(label, name string) (uuid.UUID, *frozenFile, error) {
+	idx, ok := c.priv.Snapshots[label]
+	if !ok { return uuid.Nil, nil, ErrNoSnapshot }
+	root, ok := idx.Files[name]
+	if !ok { return uuid.Nil, nil, ErrNotFound }
+	snap, ok := c.store.Snapshots[idx.ID]
+	if !ok { return uuid.Nil, nil, ErrNoSnapshot }
+	return root, snap.Files[root], nil
+}
+
+func (rec *fileRecord) freeze() *frozenFile {
+	f := &frozenFile{
+		Key:     copyBytes(rec.Key),
+		Chunks:  append([]uuid.UUID{}, rec.Chunks...),
+		Offsets: append([]int64{}, rec.Offsets...),
+		Size:    rec.Size,
+		Hashes:  append([][]byte{}, rec.Hashes...),
+		Escrow:  copyBytes(rec.Escrow),
+
+		Compression: rec.Compression,
+		Dedup:       rec.Dedup,
+	}
+	if rec.Padding != nil {
+		p := *rec.Padding
+		f.Padding = &p
+	}
+	if rec.History != nil {
+		p := rec.History.Policy
+		f.Retention = &p
+	}
+	return f
+}
+
+// record returns a detached file record sharing f's key, chunk list and
+// settings. History starts out empty.
+func (f *frozenFile) record() *fileRecord {
+	rec := &fileRecord{
+		Key:     copyBytes(f.Key),
+		Chunks:  append([]uuid.UUID{}, f.Chunks...),
+		Offsets: append([]int64{}, f.Offsets...),
+		Size:    f.Size,
+		Hashes:  append([][]byte{}, f.Hashes...),
+		Escrow:  copyBytes(f.Escrow),
+
+		Compression: f.Compression,
+		Dedup:       f.Dedup,
+	}
+	if f.Padding != nil {
+		p := *f.Padding
+		rec.Padding = &p
+	}
+	if f.Retention != nil {
+		rec.History = &fileHistory{Next: 1, Policy: *f.Retention}
+	}
+	rec.updateRoot()
+	return rec
+}
+
+// thaw makes the file at root match f, recreating the record with f's
+// settings if it is gone. A live record keeps its own settings. The
+// replaced state is checkpointed like any other write.
+func (s *Store) thaw(root uuid.UUID, f *frozenFile) error {
+	rec, ok := s.Files[root]
+	if !ok {
+		s.Files[root] = f.record()
+		s.ref(f.Chunks)
+		return nil
+	}
+	if !bytes.Equal(rec.Key, f.Key) {
+		// the record's key changed under us; re-seal under the current one
+		pt, err := s.readChunks(f.record(), 0, len(f.Chunks))
+		if err != nil {
+			return err
+		}
+		s.checkpoint(rec)
+		return s.spliceChunks(rec, 0, len(rec.Chunks), pt)
+	}
+	if sameChunks(rec.Chunks, f.Chunks) {
+		return nil
+	}
+	s.checkpoint(rec)
+	old := rec.Chunks
+	thawed := f.record()
+	rec.Chunks, rec.Offsets, rec.Size = thawed.Chunks, thawed.Offsets, thawed.Size
+	rec.Hashes, rec.Root = thawed.Hashes, thawed.Root
+	s.ref(rec.Chunks)
+	s.dropChunks(old)
+	return nil
+}
+
+// pinsFor returns every snapshot pin of the file at root.
+func (s *Store) pinsFor(root uuid.UUID) []*frozenFile {
+	var out []*frozenFile
+	for _, snap := range s.Snapshots {
+		if f, ok := snap.Files[root]; ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func sameChunks(a, b []uuid.UUID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,32 +1,104 @@
 package securefs
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // Store persists everything in a single JSON file for demo purposes.
 type Store struct {
-	mu     sync.RWMutex
-	path   string
+	mu       sync.RWMutex
+	path     string
+	encoding Encoding // how the file at path is laid out
+
+	Format int    // on-disk layout version, see StoreFormat
 	Secret []byte // random store secret for signing share codes
+	Cipher Suite  `json:",omitempty"` // AEAD for new ciphertexts; zero means AES-256-GCM
+
+	// LegacyKeySchedule is set on stores migrated from builds that derived
+	// user keys with legacyDeriveKey; only those let such users log in.
+	LegacyKeySchedule bool `json:",omitempty"`
+
+	// OrgEscrow, when set, is a compliance key every new file key is also
+	// sealed to; see orgescrow.go. It is public so every user can see it.
+	OrgEscrow *OrgEscrowPolicy `json:",omitempty"`
+
+	// Rollback and fork protection; see epoch.go.
+	ID        uuid.UUID   // names the store in clients' state files
+	Epoch     uint64      // bumped on every save
+	Nonce     []byte      // random per save, so diverging writers get distinct heads
+	Heads     []epochHead // recent heads, oldest first; the last is current
+	statePath string      // local state file, "" if not tracking
+	digest    []byte      // contentDigest as of the last load or save
+	signer    *headSigner // user saves are signed as, nil for none
+
+	resealLegacy bool // set by migrateV8: chunks may lack a key commitment
+
+	rand  io.Reader        // randomness for keys, nonces and salts; nil means crypto/rand
+	uuids func() uuid.UUID // record, chunk and snapshot IDs; nil means uuid.New
+	clock func() time.Time // version and snapshot times; nil means time.Now
 
 	Users  map[string]*userRecord
 	Files  map[uuid.UUID]*fileRecord
 	Chunks map[uuid.UUID][]byte
+	Refs   map[uuid.UUID]int `json:",omitempty"` // chunk -> chunk lists naming it; see chunks.go
+
+	Snapshots map[uuid.UUID]*snapshotRecord
+	Groups    map[string]*groupRecord `json:",omitempty"` // see groups.go
+}
+
+// Option configures OpenStore.
+type Option func(*Store)
+
+// WithStateFile makes the store remember, in the local file at path, the
+// newest epoch this machine has seen for it. OpenStore then refuses a copy
+// that is older (ErrRollback) or whose history diverges (ErrFork).
+func WithStateFile(path string) Option {
+	return func(s *Store) { s.statePath = path }
 }
 
-func OpenStore(path string) (*Store, error) {
+// WithRand makes the store draw all randomness (nonces, salts, the store
+// secret) from r instead of crypto/rand. Only for tests: a predictable r
+// makes every ciphertext predictable.
+func WithRand(r io.Reader) Option {
+	return func(s *Store) { s.rand = r }
+}
+
+// WithUUIDs makes the store take new IDs from gen instead of uuid.New.
+func WithUUIDs(gen func() uuid.UUID) Option {
+	return func(s *Store) { s.uuids = gen }
+}
+
+// WithClock makes the store read the time from now instead of time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) { s.clock = now }
+}
+
+// Together WithRand, WithUUIDs and WithClock make a store deterministic:
+// the same sequence of calls produces a byte-identical file, which is
+// what golden-file tests and bug reproductions need.
+
+func OpenStore(path string, opts ...Option) (*Store, error) {
 	s := &Store{
 		path:   path,
-		Secret: RandomBytes(32),
+		Format: StoreFormat,
 		Users:  make(map[string]*userRecord),
 		Files:  make(map[uuid.UUID]*fileRecord),
 		Chunks: make(map[uuid.UUID][]byte),
+
+		Snapshots: make(map[uuid.UUID]*snapshotRecord),
+		Groups:    make(map[string]*groupRecord),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	// Load if exists
 	if _, err := os.Stat(path); err == nil {
@@ -34,25 +106,60 @@ func OpenStore(path string) (*Store, error) {
 		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(b, s); err != nil {
+		doc, target := b, any(s)
+		if isBinary(b) {
+			meta, chunks, err := decodeBinary(b)
+			if err != nil {
+				return nil, err
+			}
+			s.encoding, s.Chunks = EncodingBinary, chunks
+			doc, target = meta, &storeMeta{Store: s}
+		}
+		doc, migrated, err := s.upgrade(path, b, doc)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(doc, target); err != nil {
 			return nil, err
 		}
 		// Defensive: ensure maps non-nil
 		if s.Users == nil { s.Users = make(map[string]*userRecord) }
 		if s.Files == nil { s.Files = make(map[uuid.UUID]*fileRecord) }
 		if s.Chunks == nil { s.Chunks = make(map[uuid.UUID][]byte) }
+		if s.Snapshots == nil { s.Snapshots = make(map[uuid.UUID]*snapshotRecord) }
+		if s.Groups == nil { s.Groups = make(map[string]*groupRecord) }
+		if s.Refs == nil { s.Refs = s.refCounts() } // absent: older store, or no chunks
+		if err := s.checkEpoch(migrated); err != nil { return nil, err }
+		if s.resealLegacy {
+			if err := s.resealLegacyChunks(); err != nil { return nil, err }
+		}
+		if migrated {
+			if err := s.Save(); err != nil { return nil, err }
+		}
 		return s, nil
 	}
+	secret, err := randomBytes(s.random(), 32)
+	if err != nil {
+		return nil, err
+	}
+	s.ID, s.Secret, s.Refs = s.newID(), secret, make(map[uuid.UUID]int)
 	return s, nil
 }
 
 func (s *Store) Save() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	b, err := json.MarshalIndent(s, "", "  ")
-	if err != nil { return err }
-	return os.WriteFile(s.path, b, 0o600)
+	return s.persist()
+}
+
+// saveAs saves the store with heads signed by sg, which saves that follow
+// without a client keep using.
+func (s *Store) saveAs(sg *headSigner) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signer = sg
+	return s.persist()
 }
 
 func (s *Store) withWrite(fn func() error) error {
@@ -60,10 +167,139 @@ func (s *Store) withWrite(fn func() error) error {
 	defer s.mu.Unlock()
 	err := fn()
 	if err != nil { return err }
-	// persist
-	b, err := json.MarshalIndent(s, "", "  ")
+	return s.persist()
+}
+
+// persist advances the epoch, writes the store and records the new head
+// in the local state file. The caller holds s.mu.
+func (s *Store) persist() error {
+	if err := s.advanceEpoch(); err != nil { return err }
+	if err := writeAtomic(s.path, s.encodeTo); err != nil { return err }
+	return s.rememberEpoch()
+}
+
+// Encoding reports how the store file is laid out on disk.
+func (s *Store) Encoding() Encoding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.encoding
+}
+
+// SetEncoding converts the store file to e, rewriting it atomically.
+func (s *Store) SetEncoding(e Encoding) error {
+	if e != EncodingJSON && e != EncodingBinary {
+		return errors.New("unknown store encoding")
+	}
+	return s.withWrite(func() error {
+		s.encoding = e
+		return nil
+	})
+}
+
+// SetCipher makes suite the AEAD for everything sealed from now on.
+// Existing ciphertexts name their own suite and stay readable.
+func (s *Store) SetCipher(suite Suite) error {
+	if _, err := newAEAD(suite, make([]byte, 32)); err != nil {
+		return err
+	}
+	return s.withWrite(func() error {
+		s.Cipher = suite
+		return nil
+	})
+}
+
+// CipherSuite reports the AEAD new ciphertexts are sealed with.
+func (s *Store) CipherSuite() Suite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.suite()
+}
+
+// openUserState opens rec's EncUser under its state key. Users still on a
+// password-derived key schedule may have been sealed by builds that did
+// not commit to the key; that schedule is itself checked by the password
+// (any other schedule derives a key that opens nothing), and their login
+// reseals the state and moves them off it.
+func openUserState(rec *userRecord, key []byte) ([]byte, error) {
+	return open(key, rec.EncUser, nil, rec.Schedule != scheduleWrapped)
+}
+
+func (s *Store) newID() uuid.UUID {
+	if s.uuids == nil {
+		return uuid.New()
+	}
+	return s.uuids()
+}
+
+func (s *Store) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+// random is the store's source of randomness.
+func (s *Store) random() io.Reader {
+	if s.rand == nil {
+		return rand.Reader
+	}
+	return s.rand
+}
+
+func (s *Store) suite() Suite {
+	if s.Cipher == 0 {
+		return SuiteAESGCM
+	}
+	return s.Cipher
+}
+
+// encodeTo serializes the store in its current encoding. Both encodings
+// are deterministic, so equal stores encode to equal bytes.
+func (s *Store) encodeTo(w io.Writer) error {
+	if s.encoding == EncodingBinary {
+		return encodeBinary(w, s)
+	}
+	b, err := json.Marshal(s)
 	if err != nil { return err }
-	return os.WriteFile(s.path, b, 0o600)
+	_, err = w.Write(b)
+	return err
+}
+
+// writeAtomic streams write into a temp file beside path, syncs it and
+// renames it over path, so readers see either the old store or the new one.
+func writeAtomic(path string, write func(io.Writer) error) error {
+	return replaceFile(path, write, nil)
+}
+
+// replaceFile is writeAtomic with a hook: check, if non-nil, runs against
+// the synced temp file and can veto the rename.
+func replaceFile(path string, write func(io.Writer) error, check func(tmp string) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil { return err }
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil { return err }
+	if err := os.Chmod(tmp, 0o600); err != nil { return err }
+	if check != nil {
+		if err := check(tmp); err != nil { return err }
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeBytes adapts a byte slice for writeAtomic.
+func writeBytes(b []byte) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}
 }
 
 // Helpers
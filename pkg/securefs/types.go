@@ -1,20 +1,130 @@
 package securefs
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type userRecord struct {
 	Username string
 	Salt     []byte
-	EncUser  []byte // encrypted userPrivate with master key
+	Schedule int    `json:",omitempty"` // key schedule, see keyschedule.go
+	Wrapped  []byte `json:",omitempty"` // user keys under the password key
+	EncUser  []byte // encrypted userPrivate with the state key
+	Tracked  bool   `json:",omitempty"` // every index entry has its holder tag; see gc.go
+
+	PublicKey []byte          `json:",omitempty"` // X25519, see pubkey.go
+	SignKey   []byte          `json:",omitempty"` // Ed25519 for epoch heads, see epoch.go
+	Recovery  []*recoveryCode `json:",omitempty"` // unused recovery codes
+	Escrow    *escrowRecord   `json:",omitempty"` // trustee shares, see escrow.go
+	Inbox     []*inboxEntry   `json:",omitempty"` // sealed messages, see inbox.go
 }
 
 type userPrivate struct {
-	FileIndex map[string]uuid.UUID // filename -> file root
+	FileIndex  map[string]uuid.UUID   // filename -> file root
+	PrivateKey []byte                 `json:",omitempty"` // X25519 private key
+	GroupFiles map[string]string      `json:",omitempty"` // filename -> group it came from
+	Shared     map[uuid.UUID][]string `json:",omitempty"` // root -> users shared with directly
+
+	Snapshots map[string]*snapshotIndex `json:",omitempty"` // label -> snapshot
+}
+
+// snapshotIndex is the owner's private view of a snapshot: which names
+// mapped to which roots when it was taken.
+type snapshotIndex struct {
+	ID    uuid.UUID
+	Time  time.Time
+	Files map[string]uuid.UUID // filename -> file root
 }
 
 type fileRecord struct {
-	Key    []byte      // 32-byte symmetric key
-	Chunks []uuid.UUID // ordered list of chunk IDs
+	Key     []byte      // 32-byte symmetric key
+	Chunks  []uuid.UUID // ordered list of chunk IDs
+	Offsets []int64     // plaintext offset of each chunk
+	Size    int64       // total plaintext size
+	Hashes  [][]byte    // SHA-256 of each chunk's plaintext
+	Root    []byte      // Merkle root over the chunks, see merkle.go
+
+	History *fileHistory `json:",omitempty"` // nil unless history is enabled
+	Dedup   bool         `json:",omitempty"` // content-defined, deduplicated chunks; see dedup.go
+
+	Compression Codec          `json:",omitempty"` // codec for new chunks; see codec.go
+	Padding     *PaddingPolicy `json:",omitempty"` // nil for no padding; see padding.go
+
+	// Escrow is Key sealed to the store's org escrow key, when one was
+	// set as Key was made; see orgescrow.go.
+	Escrow []byte `json:",omitempty"`
+
+	// Holders has one opaque tag per index entry (any user's) bound to
+	// this record, so GC can tell reachable files apart without reading
+	// encrypted indexes. nil means the record predates tracking.
+	Holders [][]byte
+}
+
+// fileHistory holds the retained prior states of a file. Versions share
+// chunk IDs with the current state and with each other; a chunk is only
+// deleted once nothing in the record refers to it.
+type fileHistory struct {
+	Policy   RetentionPolicy
+	Next     int // number given to the next recorded version
+	Versions []*fileVersion
+}
+
+// fileVersion is an immutable chunk list captured before a mutation.
+type fileVersion struct {
+	Version int
+	Time    time.Time
+	Chunks  []uuid.UUID
+	Offsets []int64
+	Size    int64
+	Hashes  [][]byte
+}
+
+// snapshotRecord pins the state of every file in one user's namespace at
+// a point in time. Names stay in the owner's encrypted snapshotIndex; the
+// pins are visible so chunk release and GC know what a snapshot holds.
+type snapshotRecord struct {
+	Time  time.Time
+	Files map[uuid.UUID]*frozenFile // file root -> frozen state
+}
+
+// frozenFile is a file's chunk list as captured by a snapshot. It carries
+// the file key and settings so the file can be restored after its record
+// is gone.
+type frozenFile struct {
+	Key     []byte
+	Chunks  []uuid.UUID
+	Offsets []int64
+	Size    int64
+	Hashes  [][]byte
+	Escrow  []byte `json:",omitempty"`
+
+	Compression Codec            `json:",omitempty"`
+	Padding     *PaddingPolicy   `json:",omitempty"`
+	Dedup       bool             `json:",omitempty"`
+	Retention   *RetentionPolicy `json:",omitempty"` // history policy, if on; versions are not pinned
+}
+
+// SnapshotInfo describes one of a user's snapshots.
+type SnapshotInfo struct {
+	Label string
+	Time  time.Time
+	Files int
+}
+
+// RetentionPolicy bounds how much history a file keeps. Zero fields mean
+// no limit on that axis.
+type RetentionPolicy struct {
+	KeepVersions int           // keep at most this many versions
+	KeepFor      time.Duration // drop versions older than this
+}
+
+// VersionInfo describes one retained version of a file.
+type VersionInfo struct {
+	Version int
+	Time    time.Time
+	Size    int64
 }
 
 // ShareCode is a signed capability string containing file root and key.
@@ -0,0 +1,77 @@
+package securefs
+
+import "errors"
+
+// WriteAt overwrites len(data) bytes of the named file starting at off.
+// Only the chunks overlapping the range are decrypted and re-sealed; the
+// file keeps its root and key, so existing shares see the change. Writing
+// past the end grows the file, zero-filling any gap.
+func (c *Client) WriteAt(name string, off int64, data []byte) error {
+	if off < 0 {
+		return errors.New("negative offset")
+	}
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return err }
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if off > rec.Size {
+		data = append(make([]byte, off-rec.Size), data...)
+		off = rec.Size
+	}
+	end := off + int64(len(data))
+
+	i, j := len(rec.Chunks), len(rec.Chunks)
+	if off < rec.Size {
+		i = chunkAt(rec.Offsets, off)
+	}
+	if end < rec.Size {
+		j = chunkAt(rec.Offsets, end-1) + 1
+	}
+	old, err := c.store.readChunks(rec, i, j)
+	if err != nil { return err }
+
+	start := rec.Size
+	if i < len(rec.Chunks) {
+		start = rec.Offsets[i]
+	}
+	seg := append([]byte{}, old[:off-start]...)
+	seg = append(seg, data...)
+	if tail := end - start; tail < int64(len(old)) {
+		seg = append(seg, old[tail:]...)
+	}
+	c.store.checkpoint(rec)
+	if err := c.store.spliceChunks(rec, i, j, seg); err != nil { return err }
+	return c.persist()
+}
+
+// Truncate changes the size of the named file. Shrinking drops whole
+// chunks past size and re-seals the one it cuts through; growing appends
+// zero bytes.
+func (c *Client) Truncate(name string, size int64) error {
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	rec, err := c.record(name)
+	if err != nil { return err }
+	if !rec.indexed() {
+		if err := c.store.reindex(rec); err != nil { return err }
+	}
+	if size == rec.Size {
+		return nil
+	}
+	if size > rec.Size {
+		c.store.checkpoint(rec)
+		if err := c.store.appendChunks(rec, make([]byte, size-rec.Size)); err != nil { return err }
+		return c.persist()
+	}
+	i := chunkAt(rec.Offsets, size)
+	keep, err := c.store.readChunks(rec, i, i+1)
+	if err != nil { return err }
+	c.store.checkpoint(rec)
+	if err := c.store.spliceChunks(rec, i, len(rec.Chunks), keep[:size-rec.Offsets[i]]); err != nil { return err }
+	return c.persist()
+}